@@ -1,5 +1,9 @@
 package base
 
+import (
+	"time"
+)
+
 // Configure this program using the following parameters.
 type Configuration struct {
 	Mode      string
@@ -7,20 +11,64 @@ type Configuration struct {
 	NumTaxis  int32
 	MaxRoutes int32
 
+	// The time-of-day speed model: {'constant', 'hourly', 'learned'}.
+	SpeedModel         string
+	HourlySpeedFactors []float64
+	SpeedByRoadClass   bool
+	// Lets routes with passengers take as long as the recorded trips.
+	MatchTripDuration     bool
+	TripDistanceTolerance float64
+	// How long taxis stop at pickups and dropoffs.
+	BoardingDwell  DwellConfiguration
+	AlightingDwell DwellConfiguration
+
 	MaxClients           int
 	ClientRequestsPerSec float64
+	// Where and when clients request taxis: {'uniform', 'trips', 'kde'}.
+	ClientDemand          string
+	ClientDemandBandwidth float64
+	// Assigns client requests to the closest free taxi.
+	Matcher          bool
+	MatcherMaxEta    float64
+	ClientRequestLog string
+	// When unmatched client requests expire or are cancelled.
+	ClientPatience          float64
+	ClientCancelProbability float64
 
 	TargetSpeedPerSecond     float64
 	TrackpointPrepWindowSize float64
 	TimeWarp                 float64
+	// How messages are spread over time: {'constant', 'poisson', 'realtime'}.
+	PacingProfile string
+	PacingBurst   float64
+	// How updates are generated: {'padded', 'event-time'}.
+	ReplayMode  string
+	GPSInterval float64
+	GPSNoise    NoiseConfiguration
+	// What happens if the streamer cannot keep up: {'block', 'adapt', 'shed'}.
+	BackpressurePolicy string
+	// The range of simulated time to replay, and what happens at its end: {'loop', 'stop', 'idle'}.
+	ReplayStart        string
+	ReplayEnd          string
+	ReplayEndBehaviour string
+	PreloadRoutes      bool
 
 	WebSocketPort int
 
 	TCPStream bool
 	TCPPort int
 
+	AvroSchemaId int32
+	// The per-client queue, and what happens when it is full: {'drop-oldest', 'drop-newest', 'disconnect'}.
+	ClientQueueSize    int
+	SlowConsumerPolicy string
+
 	Log bool
 
+	// Where simulated routes are stored: {'postgis', 'sqlite', 'csv', 'geojson', 'geoparquet'}.
+	Store     string
+	StoreFile string
+
 	DbUser     string
 	DbPassword string
 	DbName     string
@@ -28,3 +76,68 @@ type Configuration struct {
 	DbPort     string
 	DbSSLMode  string
 }
+
+// The errors added to location updates. Every kind of error is off while its parameter is zero.
+type NoiseConfiguration struct {
+	// Seeds the random errors, so that a replay can be repeated exactly. If 0, the seed is random.
+	Seed int64
+	// The standard deviation of the (Gaussian) position error, in metres.
+	PositionError float64
+	// How likely a fix is an outlier, and how far off outliers are on average, in metres.
+	MultipathProbability float64
+	MultipathError       float64
+	// How likely a fix is lost, sent twice, or overtaken by up to ReorderDelay later messages (default 10).
+	DropProbability      float64
+	DuplicateProbability float64
+	ReorderProbability   float64
+	ReorderDelay         int
+	// How many simulated seconds a fix is taken early or late at most.
+	TimeJitter float64
+	// If given, the true position and the fate of every fix are written to this CSV file.
+	GroundTruthFile string
+}
+
+// How long taxis stop to let passengers board or alight, in seconds. No stops are made while the mean is zero.
+type DwellConfiguration struct {
+	// How the dwell times are distributed: {'constant', 'exponential', 'lognormal'}.
+	Distribution string
+	Mean         float64
+	StdDev       float64
+}
+
+// The trip types of routes that are not recorded trips. While driving without passengers, the trip type is -1.
+// While a taxi stands at the pickup or dropoff location, the trip type tells whether passengers board or alight.
+const (
+	TripTypeBoarding  int32 = -2
+	TripTypeAlighting int32 = -3
+)
+
+// A simulated taxi route as it is written by the simulator and read by the streamer.
+// The geometry is an encoded polyline (precision 5, lat/lon order as returned by OSRM).
+type Route struct {
+	Id     int64
+	TaxiId int32
+	PuTime time.Time
+	DoTime time.Time
+
+	PassengerCount       int32
+	Distance             float64
+	Duration             float64
+	FareAmount           float64
+	Extra                float64
+	MTATax               float64
+	TipAmount            float64
+	TollsAmount          float64
+	EHailFee             float64
+	ImprovementSurcharge float64
+	TotalAmount          float64
+	PaymentType          int32
+	TripType             int32
+
+	Geometry string
+
+	StartLon float64
+	StartLat float64
+	EndLon   float64
+	EndLat   float64
+}
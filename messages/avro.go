@@ -0,0 +1,174 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Encodes messages as Avro binary, according to the schema in schema/envelope.avsc.
+//
+// Messages are framed as expected by Confluent-compatible schema registries: a zero magic byte,
+// followed by the 4-byte big-endian ID the schema is registered under, followed by the Avro data.
+type AvroEncoder struct {
+	SchemaId int32
+}
+
+func (AvroEncoder) Format() string { return FormatAvro }
+func (AvroEncoder) Binary() bool   { return true }
+
+// The indexes of the payload records in the payload union of the schema.
+var avroPayloadIndexes = map[string]int64{
+	TypeTaxiLocation:        0,
+	TypeTaxiOccupancy:       1,
+	TypeTaxiDestination:     2,
+	TypeTaxiReservation:     3,
+	TypeTaxiRouteCompleted:  4,
+	TypeClientRequest:       5,
+	TypePickupStarted:       6,
+	TypeDropoffCompleted:    7,
+	TypeRequestAssigned:     8,
+	TypeRequestRejected:     9,
+	TypeClientRequestStatus: 10,
+}
+
+func (e AvroEncoder) Encode(envelope *Envelope) ([]byte, error) {
+	index, ok := avroPayloadIndexes[envelope.Type]
+	if !ok {
+		return nil, errors.New("unknown message type '" + envelope.Type + "'")
+	}
+
+	w := avroWriter{make([]byte, 5, 128)}
+	binary.BigEndian.PutUint32(w.buf[1:5], uint32(e.SchemaId))
+
+	w.string(envelope.Type)
+	w.long(int64(envelope.Version))
+	w.long(envelope.Ts.EventTime)
+	w.long(envelope.Ts.EmitTime)
+	w.long(envelope.Ts.Seq)
+
+	w.long(index)
+	switch p := envelope.Payload.(type) {
+	case *TaxiUpdate:
+		w.long(int64(p.TaxiId))
+		w.double(p.Lon)
+		w.double(p.Lat)
+		w.long(int64(p.NumOccupants))
+		w.optionalDouble(p.DestLon)
+		w.optionalDouble(p.DestLat)
+		w.optionalDouble(p.ReservationLon)
+		w.optionalDouble(p.ReservationLat)
+		w.double(p.Heading)
+		w.double(p.Speed)
+		w.double(p.DistanceTravelled)
+		w.double(p.DistanceRemaining)
+	case *TaxiOccupancyUpdate:
+		w.long(int64(p.TaxiId))
+		w.long(int64(p.NumOccupants))
+		w.double(p.DestLon)
+		w.double(p.DestLat)
+	case *TaxiDestinationUpdate:
+		w.long(int64(p.TaxiId))
+		w.long(int64(p.NumOccupants))
+		w.double(p.DestLon)
+		w.double(p.DestLat)
+	case *TaxiReservationUpdate:
+		w.long(int64(p.TaxiId))
+		w.double(p.ReservationLon)
+		w.double(p.ReservationLat)
+	case *TaxiRouteCompletedUpdate:
+		w.long(int64(p.TaxiId))
+		w.long(int64(p.PassengerCount))
+		w.double(p.Distance)
+		w.double(p.Duration)
+		w.double(p.FareAmount)
+		w.double(p.Extra)
+		w.double(p.MTATax)
+		w.double(p.TipAmount)
+		w.double(p.TollsAmount)
+		w.double(p.EHailFee)
+		w.double(p.ImprovementSurcharge)
+		w.double(p.TotalAmount)
+		w.long(int64(p.PaymentType))
+		w.long(int64(p.TripType))
+	case *ClientRequestUpdate:
+		w.long(int64(p.ClientId))
+		w.double(p.OrigLon)
+		w.double(p.OrigLat)
+		w.double(p.DestLon)
+		w.double(p.DestLat)
+		w.bool(p.WillShare)
+		w.double(p.MaxWait)
+		w.long(p.RequestId)
+	case *PickupStartedUpdate:
+		w.long(int64(p.TaxiId))
+		w.double(p.Lon)
+		w.double(p.Lat)
+		w.long(int64(p.PassengerCount))
+		w.double(p.DwellTime)
+	case *DropoffCompletedUpdate:
+		w.long(int64(p.TaxiId))
+		w.double(p.Lon)
+		w.double(p.Lat)
+		w.long(int64(p.PassengerCount))
+		w.double(p.DwellTime)
+	case *RequestAssignedUpdate:
+		w.long(int64(p.ClientId))
+		w.long(int64(p.TaxiId))
+		w.double(p.TaxiLon)
+		w.double(p.TaxiLat)
+		w.double(p.Distance)
+		w.double(p.Eta)
+		w.long(p.RequestId)
+	case *RequestRejectedUpdate:
+		w.long(int64(p.ClientId))
+		w.string(p.Reason)
+		w.long(p.RequestId)
+	case *ClientRequestStatusUpdate:
+		w.long(p.RequestId)
+		w.long(int64(p.ClientId))
+		w.string(p.Status)
+		w.long(int64(p.TaxiId))
+		w.long(p.CreatedTime)
+	default:
+		return nil, errors.New("no avro encoding for message type '" + envelope.Type + "'")
+	}
+	return w.buf, nil
+}
+
+// Writes Avro binary data.
+type avroWriter struct {
+	buf []byte
+}
+
+// Writes an int or long, which Avro both encodes as zig-zag varint.
+func (w *avroWriter) long(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *avroWriter) double(v float64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+}
+
+// Writes a ["null", "double"] union.
+func (w *avroWriter) optionalDouble(v *float64) {
+	if v == nil {
+		w.long(0)
+		return
+	}
+	w.long(1)
+	w.double(*v)
+}
+
+func (w *avroWriter) bool(v bool) {
+	if v {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *avroWriter) string(v string) {
+	w.long(int64(len(v)))
+	w.buf = append(w.buf, v...)
+}
@@ -0,0 +1,32 @@
+package messages
+
+import (
+	"encoding/json"
+)
+
+// The formats messages can be encoded in.
+const (
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+	FormatAvro     = "avro"
+)
+
+// Encodes messages for sending them to a consumer.
+type Encoder interface {
+	Encode(envelope *Envelope) ([]byte, error)
+	// The format this encoder produces, one of the Format constants.
+	Format() string
+	// Whether the encoding is binary. Binary messages are sent as binary WebSocket frames,
+	// and are length-prefixed on TCP streams.
+	Binary() bool
+}
+
+// Encodes messages as JSON, see the JSON Schemas in the schema directory.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(envelope *Envelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+func (JSONEncoder) Format() string { return FormatJSON }
+func (JSONEncoder) Binary() bool   { return false }
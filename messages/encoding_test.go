@@ -0,0 +1,167 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// A taxi location with some fields at their default value, and an optional one set and the others unset.
+var goldenTaxiLocation = &Envelope{TypeTaxiLocation, Version,
+	Timestamps{EventTime: 1451606400000, EmitTime: 1451606400500, Seq: 42},
+	&TaxiUpdate{TaxiId: 7, Lon: -74, Lat: 40.5, DestLon: float(-73.5), Heading: 90}}
+
+// A client request status with a negative ID, and a payload field number beyond one byte in protobuf.
+var goldenClientRequestStatus = &Envelope{TypeClientRequestStatus, Version, Timestamps{},
+	&ClientRequestStatusUpdate{RequestId: 3, ClientId: 9, Status: StatusMatched, TaxiId: -1}}
+
+// Joins the given parts of an encoded message.
+func golden(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	// -74, 40.5, -73.5 and 90 as little-endian doubles.
+	doubleMinus74   = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x52, 0xc0}
+	double40_5      = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x44, 0x40}
+	doubleMinus73_5 = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x60, 0x52, 0xc0}
+	double90        = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x56, 0x40}
+	doubleZero      = make([]byte, 8)
+)
+
+func TestProtobufGolden(t *testing.T) {
+	tests := []struct {
+		envelope *Envelope
+		want     []byte
+	}{
+		{goldenTaxiLocation, golden(
+			[]byte{0x0a, 12}, []byte("taxiLocation"), // type
+			[]byte{0x10, 0x01}, // version
+			// ts: the event time, emit time (varints) and seq.
+			[]byte{0x1a, 16, 0x08, 0x80, 0xb8, 0xef, 0xd3, 0x9f, 0x2a, 0x10, 0xf4, 0xbb, 0xef, 0xd3, 0x9f, 0x2a,
+				0x18, 42},
+			// taxi_location = 10: the taxi ID, lon, lat, dest_lon and heading. The number of occupants is 0,
+			// and the other optional doubles are unset.
+			[]byte{0x52, 38, 0x08, 0x07, 0x11}, doubleMinus74, []byte{0x19}, double40_5,
+			[]byte{0x29}, doubleMinus73_5, []byte{0x49}, double90)},
+		{goldenClientRequestStatus, golden(
+			[]byte{0x0a, 19}, []byte("clientRequestStatus"),
+			[]byte{0x10, 0x01},
+			[]byte{0x1a, 0}, // ts, with all fields 0
+			// client_request_status = 20: request and client ID, status, and the sign-extended taxi ID -1.
+			[]byte{0xa2, 0x01, 24, 0x08, 0x03, 0x10, 0x09, 0x1a, 7}, []byte("matched"),
+			[]byte{0x20, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})},
+	}
+	for _, test := range tests {
+		got, err := ProtobufEncoder{}.Encode(test.envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s is encoded as\n% x\nwant\n% x", test.envelope.Type, got, test.want)
+		}
+	}
+}
+
+func TestAvroGolden(t *testing.T) {
+	header := []byte{0x00, 0x00, 0x00, 0x00, 0x05} // magic byte and schema ID 5
+	tests := []struct {
+		envelope *Envelope
+		want     []byte
+	}{
+		{goldenTaxiLocation, golden(header,
+			[]byte{24}, []byte("taxiLocation"), // type, with the zig-zag length 12
+			[]byte{0x02}, // version
+			// ts: the event time, emit time and seq as zig-zag varints.
+			[]byte{0x80, 0xf0, 0xde, 0xa7, 0xbf, 0x54, 0xe8, 0xf7, 0xde, 0xa7, 0xbf, 0x54, 0x54},
+			// payload: union index 0, then all fields of TaxiLocation in order.
+			[]byte{0x00, 0x0e}, doubleMinus74, double40_5, []byte{0x00},
+			[]byte{0x02}, doubleMinus73_5, []byte{0x00, 0x00, 0x00}, // destLon set, the others null
+			double90, doubleZero, doubleZero, doubleZero)},
+		{goldenClientRequestStatus, golden(header,
+			[]byte{38}, []byte("clientRequestStatus"),
+			[]byte{0x02},
+			[]byte{0x00, 0x00, 0x00},
+			// payload: union index 10, request and client ID, status, taxi ID -1 and created time.
+			[]byte{0x14, 0x06, 0x12, 14}, []byte("matched"), []byte{0x01, 0x00})},
+	}
+	for _, test := range tests {
+		got, err := AvroEncoder{SchemaId: 5}.Encode(test.envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s is encoded as\n% x\nwant\n% x", test.envelope.Type, got, test.want)
+		}
+	}
+}
+
+// The message type of a payload message or record in the schemas, e.g., taxiLocation for TaxiLocation.
+func schemaType(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+func TestProtobufPayloadFieldsMatchSchema(t *testing.T) {
+	proto, err := Schemas.ReadFile("schema/taxistream.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneof := regexp.MustCompile(`(?s)oneof payload \{(.*?)\}`).FindSubmatch(proto)
+	if oneof == nil {
+		t.Fatal("taxistream.proto has no payload oneof")
+	}
+	fields := regexp.MustCompile(`(\w+) \w+ = (\d+);`).FindAllSubmatch(oneof[1], -1)
+	if len(fields) != len(protobufPayloadFields) {
+		t.Errorf("the payload oneof has %d fields, the encoder %d", len(fields), len(protobufPayloadFields))
+	}
+	for _, field := range fields {
+		messageType := schemaType(string(field[1]))
+		number, _ := strconv.Atoi(string(field[2]))
+		if protobufPayloadFields[messageType] != number {
+			t.Errorf("%s is field %d of the payload oneof, but encoded as field %d", messageType, number,
+				protobufPayloadFields[messageType])
+		}
+	}
+}
+
+func TestAvroPayloadIndexesMatchSchema(t *testing.T) {
+	avsc, err := Schemas.ReadFile("schema/envelope.avsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(avsc, &schema); err != nil {
+		t.Fatal(err)
+	}
+	var union []struct {
+		Name string `json:"name"`
+	}
+	for _, field := range schema.Fields {
+		if field.Name == "payload" {
+			if err := json.Unmarshal(field.Type, &union); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(union) != len(avroPayloadIndexes) {
+		t.Errorf("the payload union has %d records, the encoder %d", len(union), len(avroPayloadIndexes))
+	}
+	for i, record := range union {
+		messageType := schemaType(record.Name)
+		if index, ok := avroPayloadIndexes[messageType]; !ok || index != int64(i) {
+			t.Errorf("%s is at index %d of the payload union, but encoded at %d", messageType, i, index)
+		}
+	}
+}
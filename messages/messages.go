@@ -0,0 +1,290 @@
+// Package messages defines the messages streamed by taxisite, so that consumers written in Go can import
+// them to decode the streams. Every message is wrapped in a versioned envelope, which states its type:
+//
+//	{"type": "taxiLocation", "version": 1, "ts": {"eventTime": ..., "emitTime": ..., "seq": ...}, "payload": {...}}
+//
+// A JSON Schema for the envelope and each payload type is published in the schema directory, along with the
+// Protobuf and Avro schemas of the binary encodings (see Encoder).
+package messages
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The version of the message format. It is increased on breaking changes only; consumers should ignore
+// fields they do not know.
+const Version = 1
+
+// The types of streamed messages.
+const (
+	TypeTaxiLocation        = "taxiLocation"
+	TypeTaxiOccupancy       = "taxiOccupancy"
+	TypeTaxiDestination     = "taxiDestination"
+	TypeTaxiReservation     = "taxiReservation"
+	TypeTaxiRouteCompleted  = "taxiRouteCompleted"
+	TypeClientRequest       = "clientRequest"
+	TypePickupStarted       = "pickupStarted"
+	TypeDropoffCompleted    = "dropoffCompleted"
+	TypeRequestAssigned     = "requestAssigned"
+	TypeRequestRejected     = "requestRejected"
+	TypeClientRequestStatus = "clientRequestStatus"
+)
+
+// The statuses of client requests, as sent in ClientRequestStatusUpdate. A request is created, may be updated
+// by the client, and is matched to a taxi, which picks the client up and completes the trip. Unless it was picked
+// up, the client may cancel it, or it expires when the client does not want to wait any longer.
+const (
+	StatusCreated   = "created"
+	StatusUpdated   = "updated"
+	StatusCancelled = "cancelled"
+	StatusMatched   = "matched"
+	StatusPickedUp  = "pickedUp"
+	StatusCompleted = "completed"
+	StatusExpired   = "expired"
+)
+
+// The payload of a message.
+type Payload interface {
+	MessageType() string
+}
+
+// The envelope every streamed message is wrapped in.
+type Envelope struct {
+	Type    string     `json:"type"`
+	Version int        `json:"version"`
+	Ts      Timestamps `json:"ts"`
+	Payload Payload    `json:"payload"`
+}
+
+// The timestamps every streamed message carries, in milliseconds since the Unix epoch.
+// The event time is the simulated time the message was generated for, the emit time is the wall-clock
+// time it was sent at, and the sequence number counts all messages of the stream, including filtered ones.
+type Timestamps struct {
+	EventTime int64 `json:"eventTime"`
+	EmitTime  int64 `json:"emitTime"`
+	Seq       int64 `json:"seq"`
+}
+
+// Wraps a payload generated for the given simulated time. Emit time and sequence number are set when sending.
+func NewEnvelope(payload Payload, eventTime time.Time) *Envelope {
+	return &Envelope{payload.MessageType(), Version, Timestamps{EventTime: toMillis(eventTime)}, payload}
+}
+
+// Sets the emit time and sequence number of a message right before it is sent.
+func (e *Envelope) Stamp(emitTime time.Time, seq int64) {
+	e.Ts.EmitTime = toMillis(emitTime)
+	e.Ts.Seq = seq
+}
+
+// Decodes a message, including its payload according to its type.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type    string          `json:"type"`
+		Version int             `json:"version"`
+		Ts      Timestamps      `json:"ts"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	payload, err := newPayload(raw.Type)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw.Payload, payload); err != nil {
+		return err
+	}
+	e.Type = raw.Type
+	e.Version = raw.Version
+	e.Ts = raw.Ts
+	e.Payload = payload
+	return nil
+}
+
+// Decodes a single message.
+func Decode(data []byte) (*Envelope, error) {
+	envelope := &Envelope{}
+	if err := json.Unmarshal(data, envelope); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// Checks if a message type is known.
+func KnownType(messageType string) bool {
+	_, err := newPayload(messageType)
+	return err == nil
+}
+
+// Creates an empty payload of the given type.
+func newPayload(messageType string) (Payload, error) {
+	switch messageType {
+	case TypeTaxiLocation:
+		return &TaxiUpdate{}, nil
+	case TypeTaxiOccupancy:
+		return &TaxiOccupancyUpdate{}, nil
+	case TypeTaxiDestination:
+		return &TaxiDestinationUpdate{}, nil
+	case TypeTaxiReservation:
+		return &TaxiReservationUpdate{}, nil
+	case TypeTaxiRouteCompleted:
+		return &TaxiRouteCompletedUpdate{}, nil
+	case TypeClientRequest:
+		return &ClientRequestUpdate{}, nil
+	case TypePickupStarted:
+		return &PickupStartedUpdate{}, nil
+	case TypeDropoffCompleted:
+		return &DropoffCompletedUpdate{}, nil
+	case TypeRequestAssigned:
+		return &RequestAssignedUpdate{}, nil
+	case TypeRequestRejected:
+		return &RequestRejectedUpdate{}, nil
+	case TypeClientRequestStatus:
+		return &ClientRequestStatusUpdate{}, nil
+	default:
+		return nil, errors.New("unknown message type '" + messageType + "'")
+	}
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// A taxi location update.
+type TaxiUpdate struct {
+	TaxiId int32   `json:"taxiId"`
+	Lon    float64 `json:"lon"`
+	Lat    float64 `json:"lat"`
+
+	NumOccupants   int32    `json:"numOccupants"`
+	DestLon        *float64 `json:"destLon"`
+	DestLat        *float64 `json:"destLat"`
+	ReservationLon *float64 `json:"reservationLon"`
+	ReservationLat *float64 `json:"reservationLat"`
+
+	// The direction of travel in degrees clockwise from north, and the speed in m/s.
+	Heading float64 `json:"heading"`
+	Speed   float64 `json:"speed"`
+	// How many meters of the current route the taxi has travelled, and how many are left.
+	DistanceTravelled float64 `json:"distanceTravelled"`
+	DistanceRemaining float64 `json:"distanceRemaining"`
+}
+
+// A taxi occupancy update.
+type TaxiOccupancyUpdate struct {
+	TaxiId       int32   `json:"taxiId"`
+	NumOccupants int32   `json:"numOccupants"`
+	DestLon      float64 `json:"destLon"`
+	DestLat      float64 `json:"destLat"`
+}
+
+// Updates where a taxi will travel to (when it gets booked).
+type TaxiDestinationUpdate struct {
+	TaxiId       int32   `json:"taxiId"`
+	NumOccupants int32   `json:"numOccupants"`
+	DestLon      float64 `json:"destLon"`
+	DestLat      float64 `json:"destLat"`
+}
+
+// Update when a taxi receives a reservation.
+type TaxiReservationUpdate struct {
+	TaxiId         int32   `json:"taxiId"`
+	ReservationLon float64 `json:"reservationLon"`
+	ReservationLat float64 `json:"reservationLat"`
+}
+
+// When a taxi finishes serving a route, its price is sent.
+type TaxiRouteCompletedUpdate struct {
+	TaxiId               int32   `json:"taxiId"`
+	PassengerCount       int32   `json:"passengerCount"`
+	Distance             float64 `json:"tripDistance"`
+	Duration             float64 `json:"tripDuration"`
+	FareAmount           float64 `json:"fareAmount"`
+	Extra                float64 `json:"extra"`
+	MTATax               float64 `json:"mtaTax"`
+	TipAmount            float64 `json:"tipAmount"`
+	TollsAmount          float64 `json:"tollsAmount"`
+	EHailFee             float64 `json:"ehailFee"`
+	ImprovementSurcharge float64 `json:"improvementSurcharge"`
+	TotalAmount          float64 `json:"totalAmount"`
+	PaymentType          int32   `json:"paymentType"`
+	TripType             int32   `json:"tripType"`
+}
+
+// A client looking for a taxi.
+type ClientRequestUpdate struct {
+	ClientId  int     `json:"clientId"`
+	OrigLon   float64 `json:"origLon"`
+	OrigLat   float64 `json:"origLat"`
+	DestLon   float64 `json:"destLon"`
+	DestLat   float64 `json:"destLat"`
+	WillShare bool    `json:"willShare"`
+	// How long the client waits for a taxi at most, in seconds. 0 means as long as clients wait by default.
+	MaxWait float64 `json:"maxWait"`
+	// Identifies the request in its status updates. Requests that are updated are sent again with the same ID.
+	RequestId int64 `json:"requestId"`
+}
+
+// Sent when a taxi stops to let passengers board. It waits at the pickup location for the dwell time.
+type PickupStartedUpdate struct {
+	TaxiId         int32   `json:"taxiId"`
+	Lon            float64 `json:"lon"`
+	Lat            float64 `json:"lat"`
+	PassengerCount int32   `json:"passengerCount"`
+	// How long the taxi waits, in seconds.
+	DwellTime float64 `json:"dwellTime"`
+}
+
+// Sent when passengers have left a taxi, after it waited at the dropoff location for the dwell time.
+type DropoffCompletedUpdate struct {
+	TaxiId         int32   `json:"taxiId"`
+	Lon            float64 `json:"lon"`
+	Lat            float64 `json:"lat"`
+	PassengerCount int32   `json:"passengerCount"`
+	// How long the taxi waited, in seconds.
+	DwellTime float64 `json:"dwellTime"`
+}
+
+// Sent when the matcher assigns a free taxi to a client request.
+type RequestAssignedUpdate struct {
+	ClientId int     `json:"clientId"`
+	TaxiId   int32   `json:"taxiId"`
+	TaxiLon  float64 `json:"taxiLon"`
+	TaxiLat  float64 `json:"taxiLat"`
+	// The estimated distance to the origin of the request (in m), and how long the taxi needs (in s).
+	Distance  float64 `json:"distance"`
+	Eta       float64 `json:"eta"`
+	RequestId int64   `json:"requestId"`
+}
+
+// Sent when the matcher finds no free taxi for a client request.
+type RequestRejectedUpdate struct {
+	ClientId  int    `json:"clientId"`
+	Reason    string `json:"reason"`
+	RequestId int64  `json:"requestId"`
+}
+
+// Sent whenever a client request changes its status, see the Status constants.
+type ClientRequestStatusUpdate struct {
+	RequestId int64  `json:"requestId"`
+	ClientId  int    `json:"clientId"`
+	Status    string `json:"status"`
+	// The taxi serving the request, or -1 while it is not matched.
+	TaxiId int32 `json:"taxiId"`
+	// When the request was created (in simulated time), in milliseconds since the Unix epoch.
+	CreatedTime int64 `json:"createdTime"`
+}
+
+func (*TaxiUpdate) MessageType() string                { return TypeTaxiLocation }
+func (*TaxiOccupancyUpdate) MessageType() string       { return TypeTaxiOccupancy }
+func (*TaxiDestinationUpdate) MessageType() string     { return TypeTaxiDestination }
+func (*TaxiReservationUpdate) MessageType() string     { return TypeTaxiReservation }
+func (*TaxiRouteCompletedUpdate) MessageType() string  { return TypeTaxiRouteCompleted }
+func (*ClientRequestUpdate) MessageType() string       { return TypeClientRequest }
+func (*PickupStartedUpdate) MessageType() string       { return TypePickupStarted }
+func (*DropoffCompletedUpdate) MessageType() string    { return TypeDropoffCompleted }
+func (*RequestAssignedUpdate) MessageType() string     { return TypeRequestAssigned }
+func (*RequestRejectedUpdate) MessageType() string     { return TypeRequestRejected }
+func (*ClientRequestStatusUpdate) MessageType() string { return TypeClientRequestStatus }
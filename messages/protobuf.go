@@ -0,0 +1,193 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Encodes messages as Protocol Buffers, according to the taxistream.Envelope message in schema/taxistream.proto.
+type ProtobufEncoder struct{}
+
+func (ProtobufEncoder) Format() string { return FormatProtobuf }
+func (ProtobufEncoder) Binary() bool   { return true }
+
+// The field numbers of the payload oneof in taxistream.Envelope.
+var protobufPayloadFields = map[string]int{
+	TypeTaxiLocation:        10,
+	TypeTaxiOccupancy:       11,
+	TypeTaxiDestination:     12,
+	TypeTaxiReservation:     13,
+	TypeTaxiRouteCompleted:  14,
+	TypeClientRequest:       15,
+	TypePickupStarted:       16,
+	TypeDropoffCompleted:    17,
+	TypeRequestAssigned:     18,
+	TypeRequestRejected:     19,
+	TypeClientRequestStatus: 20,
+}
+
+func (ProtobufEncoder) Encode(envelope *Envelope) ([]byte, error) {
+	field, ok := protobufPayloadFields[envelope.Type]
+	if !ok {
+		return nil, errors.New("unknown message type '" + envelope.Type + "'")
+	}
+
+	ts := protobufWriter{}
+	ts.int64(1, envelope.Ts.EventTime)
+	ts.int64(2, envelope.Ts.EmitTime)
+	ts.int64(3, envelope.Ts.Seq)
+
+	payload := protobufWriter{}
+	switch p := envelope.Payload.(type) {
+	case *TaxiUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.double(2, p.Lon)
+		payload.double(3, p.Lat)
+		payload.int64(4, int64(p.NumOccupants))
+		payload.optionalDouble(5, p.DestLon)
+		payload.optionalDouble(6, p.DestLat)
+		payload.optionalDouble(7, p.ReservationLon)
+		payload.optionalDouble(8, p.ReservationLat)
+		payload.double(9, p.Heading)
+		payload.double(10, p.Speed)
+		payload.double(11, p.DistanceTravelled)
+		payload.double(12, p.DistanceRemaining)
+	case *TaxiOccupancyUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.int64(2, int64(p.NumOccupants))
+		payload.double(3, p.DestLon)
+		payload.double(4, p.DestLat)
+	case *TaxiDestinationUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.int64(2, int64(p.NumOccupants))
+		payload.double(3, p.DestLon)
+		payload.double(4, p.DestLat)
+	case *TaxiReservationUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.double(2, p.ReservationLon)
+		payload.double(3, p.ReservationLat)
+	case *TaxiRouteCompletedUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.int64(2, int64(p.PassengerCount))
+		payload.double(3, p.Distance)
+		payload.double(4, p.Duration)
+		payload.double(5, p.FareAmount)
+		payload.double(6, p.Extra)
+		payload.double(7, p.MTATax)
+		payload.double(8, p.TipAmount)
+		payload.double(9, p.TollsAmount)
+		payload.double(10, p.EHailFee)
+		payload.double(11, p.ImprovementSurcharge)
+		payload.double(12, p.TotalAmount)
+		payload.int64(13, int64(p.PaymentType))
+		payload.int64(14, int64(p.TripType))
+	case *ClientRequestUpdate:
+		payload.int64(1, int64(p.ClientId))
+		payload.double(2, p.OrigLon)
+		payload.double(3, p.OrigLat)
+		payload.double(4, p.DestLon)
+		payload.double(5, p.DestLat)
+		payload.bool(6, p.WillShare)
+		payload.double(7, p.MaxWait)
+		payload.int64(8, p.RequestId)
+	case *PickupStartedUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.double(2, p.Lon)
+		payload.double(3, p.Lat)
+		payload.int64(4, int64(p.PassengerCount))
+		payload.double(5, p.DwellTime)
+	case *DropoffCompletedUpdate:
+		payload.int64(1, int64(p.TaxiId))
+		payload.double(2, p.Lon)
+		payload.double(3, p.Lat)
+		payload.int64(4, int64(p.PassengerCount))
+		payload.double(5, p.DwellTime)
+	case *RequestAssignedUpdate:
+		payload.int64(1, int64(p.ClientId))
+		payload.int64(2, int64(p.TaxiId))
+		payload.double(3, p.TaxiLon)
+		payload.double(4, p.TaxiLat)
+		payload.double(5, p.Distance)
+		payload.double(6, p.Eta)
+		payload.int64(7, p.RequestId)
+	case *RequestRejectedUpdate:
+		payload.int64(1, int64(p.ClientId))
+		payload.string(2, p.Reason)
+		payload.int64(3, p.RequestId)
+	case *ClientRequestStatusUpdate:
+		payload.int64(1, p.RequestId)
+		payload.int64(2, int64(p.ClientId))
+		payload.string(3, p.Status)
+		payload.int64(4, int64(p.TaxiId))
+		payload.int64(5, p.CreatedTime)
+	default:
+		return nil, errors.New("no protobuf encoding for message type '" + envelope.Type + "'")
+	}
+
+	w := protobufWriter{}
+	w.string(1, envelope.Type)
+	w.int64(2, int64(envelope.Version))
+	w.bytes(3, ts.buf)
+	// Payload fields are always written, even if empty, as they determine the oneof case.
+	w.bytes(field, payload.buf)
+	return w.buf, nil
+}
+
+// Writes the fields of a protobuf message. Following proto3, fields with default values are omitted
+// (except for explicitly optional ones).
+type protobufWriter struct {
+	buf []byte
+}
+
+func (w *protobufWriter) tag(field int, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// Writes an int32 or int64 field. Negative values are sign-extended, as protobuf does for both.
+func (w *protobufWriter) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, 0)
+	w.buf = binary.AppendUvarint(w.buf, uint64(v))
+}
+
+func (w *protobufWriter) bool(field int, v bool) {
+	if !v {
+		return
+	}
+	w.tag(field, 0)
+	w.buf = append(w.buf, 1)
+}
+
+func (w *protobufWriter) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, 1)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+}
+
+func (w *protobufWriter) optionalDouble(field int, v *float64) {
+	if v == nil {
+		return
+	}
+	w.tag(field, 1)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(*v))
+}
+
+func (w *protobufWriter) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	w.tag(field, 2)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *protobufWriter) bytes(field int, v []byte) {
+	w.tag(field, 2)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
@@ -0,0 +1,76 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// A ride request submitted by a client (on the client request WebSocket or via HTTP), as described by
+// schema/rideRequest.schema.json. Accepted requests are streamed as client requests. With the ID of an earlier
+// request, the request replaces that one, or cancels it.
+type RideRequest struct {
+	// The ID of an earlier request to update or cancel (as returned when it was accepted), if any.
+	RequestId *int64 `json:"requestId,omitempty"`
+	Cancel    bool   `json:"cancel"`
+	// Identifies the client. If not given, the streamer picks one.
+	ClientId  *int    `json:"clientId,omitempty"`
+	OrigLon   float64 `json:"origLon"`
+	OrigLat   float64 `json:"origLat"`
+	DestLon   float64 `json:"destLon"`
+	DestLat   float64 `json:"destLat"`
+	WillShare bool    `json:"willShare"`
+	// How long the client waits for a taxi at most, in seconds of simulated time. 0 means as long as
+	// clients wait by default.
+	MaxWait float64 `json:"maxWait"`
+}
+
+// The fields a ride request must contain.
+var rideRequestRequired = []string{"origLon", "origLat", "destLon", "destLat"}
+
+// Decodes a ride request and checks it against the schema: all locations must be given (unless the request
+// cancels an earlier one), and no unknown fields.
+func DecodeRideRequest(data []byte) (*RideRequest, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if string(fields["cancel"]) != "true" {
+		for _, name := range rideRequestRequired {
+			if _, ok := fields[name]; !ok {
+				return nil, errors.New("missing field '" + name + "'")
+			}
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	request := &RideRequest{}
+	if err := decoder.Decode(request); err != nil {
+		return nil, err
+	}
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Checks if the values of a ride request lie within the ranges of the schema.
+func (r *RideRequest) Validate() error {
+	if r.Cancel && r.RequestId == nil {
+		return errors.New("cancel requires the requestId of the request to cancel")
+	}
+	if r.ClientId != nil && *r.ClientId < 0 {
+		return errors.New("clientId must not be negative")
+	}
+	if r.OrigLon < -180 || r.OrigLon > 180 || r.DestLon < -180 || r.DestLon > 180 {
+		return errors.New("longitudes must lie between -180 and 180")
+	}
+	if r.OrigLat < -90 || r.OrigLat > 90 || r.DestLat < -90 || r.DestLat > 90 {
+		return errors.New("latitudes must lie between -90 and 90")
+	}
+	if r.MaxWait < 0 {
+		return errors.New("maxWait must not be negative")
+	}
+	return nil
+}
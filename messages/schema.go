@@ -0,0 +1,11 @@
+package messages
+
+import (
+	"embed"
+)
+
+// The JSON Schemas of the envelope and all payload types, along with the Protobuf and Avro schemas
+// of the binary encodings, as served by taxisite under /schema/.
+//
+//go:embed schema
+var Schemas embed.FS
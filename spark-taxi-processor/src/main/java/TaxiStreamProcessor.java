@@ -68,10 +68,15 @@ public class TaxiStreamProcessor {
                 try {
 
                     //TaxiUpdate taxiUpdate = gson.fromJson(record, TaxiUpdate.class);
-                    StructType schema = (new StructType()).add("lon", DoubleType).add("lat", DoubleType).add("taxiId", IntegerType);
+                    StructType payloadSchema = (new StructType()).add("lon", DoubleType).add("lat", DoubleType).add("taxiId", IntegerType);
+                    StructType schema = (new StructType()).add("type", StringType).add("payload", payloadSchema);
                     List<String> records = new ArrayList<>();
                     records.add(record);
-                    Row r = sqlContext.read().schema(schema).json(jsc.parallelize(records)).first();
+                    Row envelope = sqlContext.read().schema(schema).json(jsc.parallelize(records)).first();
+                    if (!"taxiLocation".equals(envelope.getString(0))) {
+                        return;
+                    }
+                    Row r = envelope.getStruct(1);
                     double lon = r.getDouble(0);
                     double lat = r.getDouble(1);
                     int taxiId = r.getInt(2);
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"taxistream/base"
+)
+
+// The time format used in CSV files. Simulated times carry fractions of a second, which must survive a round trip.
+const csvTimeFormat = time.RFC3339Nano
+
+// The time format of the NYC taxi data, which is also accepted when reading.
+const csvTaxiDataTimeFormat = "2006-01-02 15:04:05"
+
+// The columns of a route CSV file. The geometry is stored both as WKT (e.g. for QGIS) and as encoded polyline.
+var csvHeader = []string{"id", "taxi_id", "pickup_time", "dropoff_time", "passenger_count", "trip_distance",
+	"trip_duration", "fare_amount", "extra", "mta_tax", "tip_amount", "tolls_amount", "ehail_fee",
+	"improvement_surcharge", "total_amount", "payment_type", "trip_type", "geometry_wkt", "geometry_polyline"}
+
+// Stores routes in a CSV file, one route per row.
+type csvFormat struct{}
+
+func (csvFormat) write(filename string, routes []base.Route) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, r := range routes {
+		coords, err := decodeGeometry(r.Geometry)
+		if err != nil {
+			return err
+		}
+		err = writer.Write([]string{strconv.FormatInt(r.Id, 10), strconv.Itoa(int(r.TaxiId)),
+			r.PuTime.Format(csvTimeFormat), r.DoTime.Format(csvTimeFormat), strconv.Itoa(int(r.PassengerCount)),
+			formatFloat(r.Distance), formatFloat(r.Duration), formatFloat(r.FareAmount), formatFloat(r.Extra),
+			formatFloat(r.MTATax), formatFloat(r.TipAmount), formatFloat(r.TollsAmount), formatFloat(r.EHailFee),
+			formatFloat(r.ImprovementSurcharge), formatFloat(r.TotalAmount), strconv.Itoa(int(r.PaymentType)),
+			strconv.Itoa(int(r.TripType)), toWKT(coords), r.Geometry})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (csvFormat) read(filename string) ([]base.Route, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = len(csvHeader)
+	if _, err := reader.Read(); err != nil {
+		return nil, err
+	}
+
+	routes := make([]base.Route, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		route, err := parseCSVRoute(record)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Parses a single CSV record. If the polyline column is empty, the geometry is taken from the WKT column.
+func parseCSVRoute(record []string) (base.Route, error) {
+	p := csvParser{record: record}
+	r := base.Route{}
+	r.Id = p.int64(0)
+	r.TaxiId = int32(p.int64(1))
+	r.PuTime = p.time(2)
+	r.DoTime = p.time(3)
+	r.PassengerCount = int32(p.int64(4))
+	r.Distance = p.float(5)
+	r.Duration = p.float(6)
+	r.FareAmount = p.float(7)
+	r.Extra = p.float(8)
+	r.MTATax = p.float(9)
+	r.TipAmount = p.float(10)
+	r.TollsAmount = p.float(11)
+	r.EHailFee = p.float(12)
+	r.ImprovementSurcharge = p.float(13)
+	r.TotalAmount = p.float(14)
+	r.PaymentType = int32(p.int64(15))
+	r.TripType = int32(p.int64(16))
+	if p.err != nil {
+		return r, p.err
+	}
+
+	var coords [][]float64
+	var err error
+	if record[18] != "" {
+		r.Geometry = record[18]
+		coords, err = decodeGeometry(r.Geometry)
+	} else {
+		coords, err = fromWKT(record[17])
+		if err == nil && len(coords) == 0 {
+			err = errors.New("empty route geometry")
+		}
+		if err == nil {
+			r.Geometry = encodeGeometry(coords)
+		}
+	}
+	if err != nil {
+		return r, err
+	}
+	setEndpoints(&r, coords)
+	return r, nil
+}
+
+// Parses the fields of a CSV record, remembering the first error.
+type csvParser struct {
+	record []string
+	err    error
+}
+
+func (p *csvParser) int64(idx int) int64 {
+	v, err := strconv.ParseInt(p.record[idx], 10, 64)
+	p.keep(err)
+	return v
+}
+
+func (p *csvParser) float(idx int) float64 {
+	v, err := strconv.ParseFloat(p.record[idx], 64)
+	p.keep(err)
+	return v
+}
+
+func (p *csvParser) time(idx int) time.Time {
+	v, err := time.Parse(csvTimeFormat, p.record[idx])
+	if err != nil {
+		v, err = time.Parse(csvTaxiDataTimeFormat, p.record[idx])
+	}
+	p.keep(err)
+	return v
+}
+
+func (p *csvParser) keep(err error) {
+	if p.err == nil && err != nil {
+		p.err = err
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
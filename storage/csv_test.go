@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"taxistream/base"
+)
+
+func TestCSVRoundTripKeepsFractionalSeconds(t *testing.T) {
+	puTime := time.Date(2016, 1, 1, 0, 0, 1, 250000000, time.UTC)
+	route := base.Route{Id: 7, TaxiId: 3, PuTime: puTime, DoTime: puTime.Add(1234567891 * time.Nanosecond),
+		PassengerCount: 2, Distance: 1.5, Duration: 1.234567891, TripType: 1,
+		Geometry: encodeGeometry([][]float64{{40.75, -73.98}, {40.76, -73.97}})}
+	filename := filepath.Join(t.TempDir(), "routes.csv")
+	if err := (csvFormat{}).write(filename, []base.Route{route}); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := csvFormat{}.read(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 {
+		t.Fatalf("read %d routes, want 1", len(routes))
+	}
+	r := routes[0]
+	if !r.PuTime.Equal(route.PuTime) || !r.DoTime.Equal(route.DoTime) {
+		t.Errorf("times changed in round trip: %v-%v, want %v-%v", r.PuTime, r.DoTime, route.PuTime, route.DoTime)
+	}
+	if r.Id != route.Id || r.TaxiId != route.TaxiId || r.Geometry != route.Geometry || r.StartLon != -73.98 ||
+		r.EndLat != 40.76 {
+		t.Errorf("route changed in round trip: %+v", r)
+	}
+}
+
+func TestCSVReadsTaxiDataTimes(t *testing.T) {
+	p := csvParser{record: []string{"2016-01-01 00:29:24"}}
+	if got := p.time(0); p.err != nil || !got.Equal(time.Date(2016, 1, 1, 0, 29, 24, 0, time.UTC)) {
+		t.Errorf("parsed %v (%v)", got, p.err)
+	}
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"taxistream/base"
+)
+
+// A GeoJSON feature representing a single route.
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONLineString `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+type geoJSONLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+type geoJSONProperties struct {
+	Id                   int64     `json:"id"`
+	TaxiId               int32     `json:"taxiId"`
+	PuTime               time.Time `json:"pickupTime"`
+	DoTime               time.Time `json:"dropoffTime"`
+	PassengerCount       int32     `json:"passengerCount"`
+	Distance             float64   `json:"tripDistance"`
+	Duration             float64   `json:"tripDuration"`
+	FareAmount           float64   `json:"fareAmount"`
+	Extra                float64   `json:"extra"`
+	MTATax               float64   `json:"mtaTax"`
+	TipAmount            float64   `json:"tipAmount"`
+	TollsAmount          float64   `json:"tollsAmount"`
+	EHailFee             float64   `json:"ehailFee"`
+	ImprovementSurcharge float64   `json:"improvementSurcharge"`
+	TotalAmount          float64   `json:"totalAmount"`
+	PaymentType          int32     `json:"paymentType"`
+	TripType             int32     `json:"tripType"`
+}
+
+// Stores routes as newline-delimited GeoJSON, one feature per line.
+type geoJSONFormat struct{}
+
+func (geoJSONFormat) write(filename string, routes []base.Route) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, r := range routes {
+		coords, err := decodeGeometry(r.Geometry)
+		if err != nil {
+			return err
+		}
+		lonLats := make([][]float64, len(coords))
+		for i, c := range coords {
+			lonLats[i] = []float64{c[1], c[0]}
+		}
+		err = encoder.Encode(geoJSONFeature{"Feature", geoJSONLineString{"LineString", lonLats},
+			geoJSONProperties{r.Id, r.TaxiId, r.PuTime, r.DoTime, r.PassengerCount, r.Distance, r.Duration,
+				r.FareAmount, r.Extra, r.MTATax, r.TipAmount, r.TollsAmount, r.EHailFee,
+				r.ImprovementSurcharge, r.TotalAmount, r.PaymentType, r.TripType}})
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (geoJSONFormat) read(filename string) ([]base.Route, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	routes := make([]base.Route, 0)
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		feature := geoJSONFeature{}
+		if err := decoder.Decode(&feature); err != nil {
+			return nil, err
+		}
+		if len(feature.Geometry.Coordinates) == 0 {
+			return nil, errors.New("empty route geometry")
+		}
+		coords := make([][]float64, len(feature.Geometry.Coordinates))
+		for i, c := range feature.Geometry.Coordinates {
+			coords[i] = []float64{c[1], c[0]}
+		}
+		p := feature.Properties
+		r := base.Route{Id: p.Id, TaxiId: p.TaxiId, PuTime: p.PuTime, DoTime: p.DoTime,
+			PassengerCount: p.PassengerCount, Distance: p.Distance, Duration: p.Duration,
+			FareAmount: p.FareAmount, Extra: p.Extra, MTATax: p.MTATax, TipAmount: p.TipAmount,
+			TollsAmount: p.TollsAmount, EHailFee: p.EHailFee, ImprovementSurcharge: p.ImprovementSurcharge,
+			TotalAmount: p.TotalAmount, PaymentType: p.PaymentType, TripType: p.TripType,
+			Geometry: encodeGeometry(coords)}
+		setEndpoints(&r, coords)
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/twpayne/go-polyline"
+	"taxistream/base"
+)
+
+// Decodes the encoded polyline of a route. Coordinates are in lat/lon order.
+func decodeGeometry(geometry string) ([][]float64, error) {
+	coords, _, err := polyline.DecodeCoords([]byte(geometry))
+	if err != nil {
+		return nil, err
+	}
+	if len(coords) == 0 {
+		return nil, errors.New("empty route geometry")
+	}
+	return coords, nil
+}
+
+// Encodes lat/lon coordinates as polyline.
+func encodeGeometry(coords [][]float64) string {
+	return string(polyline.EncodeCoords(coords))
+}
+
+// Sets the start and end coordinates of a route from its geometry.
+func setEndpoints(route *base.Route, coords [][]float64) {
+	route.StartLon = coords[0][1]
+	route.StartLat = coords[0][0]
+	route.EndLon = coords[len(coords)-1][1]
+	route.EndLat = coords[len(coords)-1][0]
+}
+
+// Formats lat/lon coordinates as WKT linestring (in lon/lat order).
+func toWKT(coords [][]float64) string {
+	points := make([]string, len(coords))
+	for i, c := range coords {
+		points[i] = strconv.FormatFloat(c[1], 'f', -1, 64) + " " + strconv.FormatFloat(c[0], 'f', -1, 64)
+	}
+	return "LINESTRING (" + strings.Join(points, ", ") + ")"
+}
+
+// Parses a WKT linestring into lat/lon coordinates.
+func fromWKT(wkt string) ([][]float64, error) {
+	start := strings.Index(wkt, "(")
+	end := strings.LastIndex(wkt, ")")
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(wkt)), "LINESTRING") || start < 0 || end < start {
+		return nil, errors.New("not a WKT linestring: " + wkt)
+	}
+	coords := make([][]float64, 0)
+	for _, point := range strings.Split(wkt[start+1:end], ",") {
+		fields := strings.Fields(point)
+		if len(fields) != 2 {
+			return nil, errors.New("invalid WKT point: " + point)
+		}
+		lon, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		lat, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		coords = append(coords, []float64{lat, lon})
+	}
+	return coords, nil
+}
+
+// Encodes lat/lon coordinates as little-endian WKB linestring (in lon/lat order).
+func toWKB(coords [][]float64) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(coords)))
+	for _, c := range coords {
+		binary.Write(&buf, binary.LittleEndian, c[1])
+		binary.Write(&buf, binary.LittleEndian, c[0])
+	}
+	return buf.Bytes()
+}
+
+// Parses a WKB linestring into lat/lon coordinates.
+func fromWKB(wkb []byte) ([][]float64, error) {
+	if len(wkb) < 9 {
+		return nil, errors.New("WKB geometry too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if wkb[0] == 0 {
+		order = binary.BigEndian
+	}
+	if order.Uint32(wkb[1:5]) != 2 {
+		return nil, errors.New("WKB geometry is not a linestring")
+	}
+	numPoints := int(order.Uint32(wkb[5:9]))
+	if len(wkb) < 9+numPoints*16 {
+		return nil, errors.New("WKB linestring truncated")
+	}
+	coords := make([][]float64, numPoints)
+	for i := range coords {
+		offset := 9 + i*16
+		lon := math.Float64frombits(order.Uint64(wkb[offset : offset+8]))
+		lat := math.Float64frombits(order.Uint64(wkb[offset+8 : offset+16]))
+		coords[i] = []float64{lat, lon}
+	}
+	return coords, nil
+}
@@ -0,0 +1,108 @@
+//go:build geoparquet
+
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"taxistream/base"
+)
+
+// A route as it is stored in a GeoParquet file. The geometry is WKB-encoded.
+type geoParquetRow struct {
+	Id                   int64   `parquet:"id"`
+	TaxiId               int32   `parquet:"taxi_id"`
+	PuTime               int64   `parquet:"pickup_time,timestamp(microsecond)"`
+	DoTime               int64   `parquet:"dropoff_time,timestamp(microsecond)"`
+	PassengerCount       int32   `parquet:"passenger_count"`
+	Distance             float64 `parquet:"trip_distance"`
+	Duration             float64 `parquet:"trip_duration"`
+	FareAmount           float64 `parquet:"fare_amount"`
+	Extra                float64 `parquet:"extra"`
+	MTATax               float64 `parquet:"mta_tax"`
+	TipAmount            float64 `parquet:"tip_amount"`
+	TollsAmount          float64 `parquet:"tolls_amount"`
+	EHailFee             float64 `parquet:"ehail_fee"`
+	ImprovementSurcharge float64 `parquet:"improvement_surcharge"`
+	TotalAmount          float64 `parquet:"total_amount"`
+	PaymentType          int32   `parquet:"payment_type"`
+	TripType             int32   `parquet:"trip_type"`
+	Geometry             []byte  `parquet:"geometry"`
+}
+
+// The GeoParquet file metadata, see https://geoparquet.org.
+type geoParquetMetadata struct {
+	Version       string                              `json:"version"`
+	PrimaryColumn string                              `json:"primary_column"`
+	Columns       map[string]geoParquetColumnMetadata `json:"columns"`
+}
+
+type geoParquetColumnMetadata struct {
+	Encoding      string    `json:"encoding"`
+	GeometryTypes []string  `json:"geometry_types"`
+	Bbox          []float64 `json:"bbox,omitempty"`
+}
+
+// Stores routes in a GeoParquet file, one route per row.
+type geoParquetFormat struct{}
+
+func (geoParquetFormat) write(filename string, routes []base.Route) error {
+	rows := make([]geoParquetRow, len(routes))
+	var bbox []float64
+	for i, r := range routes {
+		coords, err := decodeGeometry(r.Geometry)
+		if err != nil {
+			return err
+		}
+		for _, c := range coords {
+			if bbox == nil {
+				bbox = []float64{c[1], c[0], c[1], c[0]}
+			}
+			bbox = []float64{min(bbox[0], c[1]), min(bbox[1], c[0]), max(bbox[2], c[1]), max(bbox[3], c[0])}
+		}
+		rows[i] = geoParquetRow{r.Id, r.TaxiId, r.PuTime.UnixMicro(), r.DoTime.UnixMicro(), r.PassengerCount,
+			r.Distance, r.Duration, r.FareAmount, r.Extra, r.MTATax, r.TipAmount, r.TollsAmount, r.EHailFee,
+			r.ImprovementSurcharge, r.TotalAmount, r.PaymentType, r.TripType, toWKB(coords)}
+	}
+
+	metadata, err := json.Marshal(geoParquetMetadata{"1.0.0", "geometry",
+		map[string]geoParquetColumnMetadata{"geometry": {"WKB", []string{"LineString"}, bbox}}})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return parquet.Write(file, rows, parquet.KeyValueMetadata("geo", string(metadata)))
+}
+
+func (geoParquetFormat) read(filename string) ([]base.Route, error) {
+	rows, err := parquet.ReadFile[geoParquetRow](filename)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]base.Route, len(rows))
+	for i, p := range rows {
+		coords, err := fromWKB(p.Geometry)
+		if err != nil {
+			return nil, err
+		}
+		r := base.Route{Id: p.Id, TaxiId: p.TaxiId,
+			PuTime: time.UnixMicro(p.PuTime).UTC(), DoTime: time.UnixMicro(p.DoTime).UTC(),
+			PassengerCount: p.PassengerCount, Distance: p.Distance, Duration: p.Duration,
+			FareAmount: p.FareAmount, Extra: p.Extra, MTATax: p.MTATax, TipAmount: p.TipAmount,
+			TollsAmount: p.TollsAmount, EHailFee: p.EHailFee, ImprovementSurcharge: p.ImprovementSurcharge,
+			TotalAmount: p.TotalAmount, PaymentType: p.PaymentType, TripType: p.TripType,
+			Geometry: encodeGeometry(coords)}
+		setEndpoints(&r, coords)
+		routes[i] = r
+	}
+	return routes, nil
+}
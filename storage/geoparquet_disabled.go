@@ -0,0 +1,23 @@
+//go:build !geoparquet
+
+package storage
+
+import (
+	"errors"
+
+	"taxistream/base"
+)
+
+// The Parquet library requires Go modules and is not part of the default build.
+type geoParquetFormat struct{}
+
+var errGeoParquetDisabled = errors.New("the geoparquet store requires building with '-tags geoparquet' " +
+	"(in module mode)")
+
+func (geoParquetFormat) write(filename string, routes []base.Route) error {
+	return errGeoParquetDisabled
+}
+
+func (geoParquetFormat) read(filename string) ([]base.Route, error) {
+	return nil, errGeoParquetDisabled
+}
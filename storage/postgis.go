@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"taxistream/base"
+)
+
+// Stores the routes in the taxi_routes table of a PostGIS database.
+type postGISStore struct {
+	db *sql.DB
+}
+
+// Sets up the connection to the database.
+func openPostGIS(conf base.Configuration) (*postGISStore, error) {
+	dataSourceName := fmt.Sprintf("host=%s port=%s dbname=%s sslmode=%s user=%s password=%s",
+		conf.DbHost, conf.DbPort, conf.DbName, conf.DbSSLMode, conf.DbUser, conf.DbPassword)
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &postGISStore{db}, nil
+}
+
+// Sets up the database, including clearing all previously generated taxi routes.
+func (s *postGISStore) setupDatabase() {
+	// Ensure we have PostGIS on the table.
+	s.db.Exec("CREATE EXTENSION IF NOT EXISTS postgis;")
+
+	s.db.Exec("CREATE SEQUENCE IF NOT EXISTS taxi_routes_id_seq INCREMENT 1 START 1 MINVALUE 1 MAXVALUE 9223372036854775807 CACHE 1;")
+	s.db.Exec("CREATE TABLE IF NOT EXISTS taxi_routes (id bigint NOT NULL DEFAULT nextval('taxi_routes_id_seq'::regclass), taxi_id integer NOT NULL, pickup_time timestamp without time zone, dropoff_time timestamp without time zone, passenger_count integer, trip_distance double precision, trip_duration double precision, fare_amount double precision, extra double precision, mta_tax double precision, tip_amount double precision, tolls_amount double precision, ehail_fee double precision, improvement_surcharge double precision, total_amount double precision, payment_type integer, trip_type integer, geometry geometry, CONSTRAINT taxi_routes_pkey PRIMARY KEY (id))")
+
+	// Clear the database.
+	s.db.Exec("TRUNCATE TABLE taxi_routes;")
+}
+
+func (s *postGISStore) WriteRoutes(routes []base.Route) error {
+	s.setupDatabase()
+	for _, r := range routes {
+		_, err := s.db.Exec("INSERT INTO taxi_routes VALUES ($1, $2, $3, $4, $5, $6, $7, $8, "+
+			"$9, $10, $11, $12, $13, $14, $15, $16, $17, ST_LineFromEncodedPolyline($18))",
+			r.Id, r.TaxiId, r.PuTime, r.DoTime, r.PassengerCount,
+			r.Distance, r.Duration, r.FareAmount, r.Extra,
+			r.MTATax, r.TipAmount, r.TollsAmount, r.EHailFee,
+			r.ImprovementSurcharge, r.TotalAmount, r.PaymentType,
+			r.TripType, r.Geometry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create an index on the time columns.
+func (s *postGISStore) CreateIndexes() error {
+	s.db.Exec("CREATE INDEX taxi_routes_pickup_time_idx ON taxi_routes (pickup_time);")
+	s.db.Exec("CREATE INDEX taxi_routes_dropoff_time_idx ON taxi_routes (dropoff_time);")
+	s.db.Exec("CREATE INDEX taxi_routes_id_idx ON taxi_routes (id);")
+	return nil
+}
+
+func (s *postGISStore) GetRoutes(windowStart time.Time, windowEnd time.Time, ids []int64) ([]base.Route, error) {
+	// A nil array is sent as NULL, and no id is <> ALL (NULL).
+	if ids == nil {
+		ids = []int64{}
+	}
+	rows, err := s.db.Query("SELECT id, taxi_id, pickup_time, dropoff_time, passenger_count, "+
+		"trip_distance, trip_duration, fare_amount, extra, mta_tax, tip_amount, tolls_amount, ehail_fee, "+
+		"improvement_surcharge, total_amount, payment_type, trip_type, ST_AsEncodedPolyline(geometry), "+
+		"ST_X(ST_StartPoint(geometry)), ST_Y(ST_StartPoint(geometry)), "+
+		"ST_X(ST_EndPoint(geometry)), ST_Y(ST_EndPoint(geometry)) "+
+		"FROM taxi_routes WHERE dropoff_time > $1 AND pickup_time < $2 AND id <> ALL ($3)",
+		windowStart, windowEnd, pq.Int64Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	routes := make([]base.Route, 0)
+	for rows.Next() {
+		route := base.Route{}
+		err := rows.Scan(&route.Id, &route.TaxiId, &route.PuTime, &route.DoTime, &route.PassengerCount,
+			&route.Distance, &route.Duration, &route.FareAmount, &route.Extra, &route.MTATax, &route.TipAmount,
+			&route.TollsAmount, &route.EHailFee, &route.ImprovementSurcharge, &route.TotalAmount,
+			&route.PaymentType, &route.TripType, &route.Geometry, &route.StartLon, &route.StartLat,
+			&route.EndLon, &route.EndLat)
+		if err != nil {
+			fmt.Println("Error (parsing route data):", err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+func (s *postGISStore) TimeRange() (time.Time, time.Time, error) {
+	var start, end sql.NullTime
+	err := s.db.QueryRow("SELECT min(pickup_time), max(dropoff_time) FROM taxi_routes").Scan(&start, &end)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !start.Valid || !end.Valid {
+		return time.Time{}, time.Time{}, errors.New("no routes in taxi_routes")
+	}
+	return start.Time, end.Time, nil
+}
+
+func (s *postGISStore) Close() error {
+	return s.db.Close()
+}
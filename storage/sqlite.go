@@ -0,0 +1,170 @@
+//go:build sqlite
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"taxistream/base"
+)
+
+// Stores the routes in an embedded SQLite database, so a bundled dataset can be streamed without a database server.
+// Times are stored as Unix microseconds and the geometry as encoded polyline, together with its endpoints,
+// so no spatial extension is needed to serve the streamer's window queries.
+type sqliteStore struct {
+	db *sql.DB
+	// The duration of the longest route in microseconds, which bounds the pickup times a window query has to scan.
+	// Negative while unknown.
+	maxDuration int64
+}
+
+// Opens (or creates) the SQLite database in the given file.
+func openSQLite(filename string) (*sqliteStore, error) {
+	if filename == "" {
+		return nil, errors.New("the sqlite store requires 'storeFile' to be set")
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db, -1}, nil
+}
+
+// Sets up the database, including clearing all previously generated taxi routes.
+func (s *sqliteStore) setupDatabase(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS taxi_routes (id INTEGER PRIMARY KEY, taxi_id INTEGER NOT NULL, " +
+		"pickup_time INTEGER, dropoff_time INTEGER, passenger_count INTEGER, trip_distance REAL, trip_duration REAL, " +
+		"fare_amount REAL, extra REAL, mta_tax REAL, tip_amount REAL, tolls_amount REAL, ehail_fee REAL, " +
+		"improvement_surcharge REAL, total_amount REAL, payment_type INTEGER, trip_type INTEGER, geometry TEXT, " +
+		"start_lon REAL, start_lat REAL, end_lon REAL, end_lat REAL)")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM taxi_routes")
+	return err
+}
+
+func (s *sqliteStore) WriteRoutes(routes []base.Route) error {
+	s.maxDuration = -1
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.setupDatabase(tx)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO taxi_routes VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, " +
+		"?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range routes {
+		coords, err := decodeGeometry(r.Geometry)
+		if err != nil {
+			return err
+		}
+		setEndpoints(&r, coords)
+		_, err = stmt.Exec(r.Id, r.TaxiId, r.PuTime.UnixMicro(), r.DoTime.UnixMicro(), r.PassengerCount,
+			r.Distance, r.Duration, r.FareAmount, r.Extra, r.MTATax, r.TipAmount, r.TollsAmount, r.EHailFee,
+			r.ImprovementSurcharge, r.TotalAmount, r.PaymentType, r.TripType, r.Geometry,
+			r.StartLon, r.StartLat, r.EndLon, r.EndLat)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Creates a time index on pickup and dropoff. Window queries scan the pickup times from the window start minus
+// the longest route duration to the window end, and take the dropoff times from the index.
+func (s *sqliteStore) CreateIndexes() error {
+	_, err := s.db.Exec("CREATE INDEX IF NOT EXISTS taxi_routes_time_idx ON taxi_routes (pickup_time, dropoff_time)")
+	return err
+}
+
+// Gets the duration of the longest route, unless it is already known.
+func (s *sqliteStore) longestRoute() (int64, error) {
+	if s.maxDuration >= 0 {
+		return s.maxDuration, nil
+	}
+	var maxDuration sql.NullInt64
+	err := s.db.QueryRow("SELECT max(dropoff_time - pickup_time) FROM taxi_routes").Scan(&maxDuration)
+	if err != nil {
+		return 0, err
+	}
+	s.maxDuration = max(maxDuration.Int64, 0)
+	return s.maxDuration, nil
+}
+
+func (s *sqliteStore) GetRoutes(windowStart time.Time, windowEnd time.Time, ids []int64) ([]base.Route, error) {
+	maxDuration, err := s.longestRoute()
+	if err != nil {
+		return nil, err
+	}
+	// A route intersecting the window was picked up at most maxDuration before the window start.
+	rows, err := s.db.Query("SELECT id, taxi_id, pickup_time, dropoff_time, passenger_count, "+
+		"trip_distance, trip_duration, fare_amount, extra, mta_tax, tip_amount, tolls_amount, ehail_fee, "+
+		"improvement_surcharge, total_amount, payment_type, trip_type, geometry, "+
+		"start_lon, start_lat, end_lon, end_lat "+
+		"FROM taxi_routes WHERE pickup_time >= ? AND pickup_time < ? AND dropoff_time > ?",
+		windowStart.UnixMicro()-maxDuration, windowEnd.UnixMicro(), windowStart.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// SQLite has no array parameters, so the active routes are excluded here.
+	excluded := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	routes := make([]base.Route, 0)
+	for rows.Next() {
+		route := base.Route{}
+		var puTime, doTime int64
+		err := rows.Scan(&route.Id, &route.TaxiId, &puTime, &doTime, &route.PassengerCount,
+			&route.Distance, &route.Duration, &route.FareAmount, &route.Extra, &route.MTATax, &route.TipAmount,
+			&route.TollsAmount, &route.EHailFee, &route.ImprovementSurcharge, &route.TotalAmount,
+			&route.PaymentType, &route.TripType, &route.Geometry, &route.StartLon, &route.StartLat,
+			&route.EndLon, &route.EndLat)
+		if err != nil {
+			return nil, err
+		}
+		if excluded[route.Id] {
+			continue
+		}
+		route.PuTime = time.UnixMicro(puTime).UTC()
+		route.DoTime = time.UnixMicro(doTime).UTC()
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+func (s *sqliteStore) TimeRange() (time.Time, time.Time, error) {
+	var start, end sql.NullInt64
+	err := s.db.QueryRow("SELECT min(pickup_time), max(dropoff_time) FROM taxi_routes").Scan(&start, &end)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !start.Valid || !end.Valid {
+		return time.Time{}, time.Time{}, errors.New("no routes in taxi_routes")
+	}
+	return time.UnixMicro(start.Int64).UTC(), time.UnixMicro(end.Int64).UTC(), nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
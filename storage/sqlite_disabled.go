@@ -0,0 +1,12 @@
+//go:build !sqlite
+
+package storage
+
+import (
+	"errors"
+)
+
+// The SQLite driver requires cgo and is not part of the default build.
+func openSQLite(filename string) (MovementStore, error) {
+	return nil, errors.New("the sqlite store requires building with '-tags sqlite' (and cgo)")
+}
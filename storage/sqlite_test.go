@@ -0,0 +1,52 @@
+//go:build sqlite
+
+package storage
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"taxistream/base"
+)
+
+func TestSQLiteWindowQueryFindsLongRoutes(t *testing.T) {
+	store, err := openSQLite(filepath.Join(t.TempDir(), "routes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	geometry := encodeGeometry([][]float64{{40.75, -73.98}, {40.76, -73.97}})
+	routes := []base.Route{
+		// A long route starting well before the window.
+		{Id: 1, PuTime: start, DoTime: start.Add(2 * time.Hour), Geometry: geometry},
+		{Id: 2, PuTime: start.Add(90 * time.Minute), DoTime: start.Add(95 * time.Minute), Geometry: geometry},
+		// Ends exactly at the window start, so it does not intersect it.
+		{Id: 3, PuTime: start.Add(50 * time.Minute), DoTime: start.Add(time.Hour), Geometry: geometry},
+		// Starts exactly at the window end.
+		{Id: 4, PuTime: start.Add(100 * time.Minute), DoTime: start.Add(110 * time.Minute), Geometry: geometry},
+		{Id: 5, PuTime: start.Add(59 * time.Minute), DoTime: start.Add(61 * time.Minute), Geometry: geometry},
+	}
+	if err := store.WriteRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.GetRoutes(start.Add(time.Hour), start.Add(100*time.Minute), []int64{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, len(found))
+	for i, r := range found {
+		ids[i] = r.Id
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 5 {
+		t.Errorf("window returned routes %v, want [1 5]", ids)
+	}
+}
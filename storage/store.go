@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"taxistream/base"
+)
+
+// A movement store persists the routes generated by the simulator and serves them to the streamer.
+//
+// Besides PostGIS, there are file-backed stores, which allow producing and streaming a simulated
+// dataset on a machine without a database, and sharing it as a single file. GeoPackage is out of scope;
+// datasets can be converted from the CSV (WKT) or GeoJSON files, e.g. with ogr2ogr.
+type MovementStore interface {
+	// Replaces all previously stored routes with the given ones.
+	WriteRoutes(routes []base.Route) error
+	// Creates the indexes required for efficient window queries (if the store supports any).
+	CreateIndexes() error
+	// Gets all routes intersecting the window (windowStart, windowEnd) that are not in ids.
+	GetRoutes(windowStart time.Time, windowEnd time.Time, ids []int64) ([]base.Route, error)
+	// Gets the earliest pickup and the latest dropoff time of all stored routes.
+	TimeRange() (time.Time, time.Time, error)
+	Close() error
+}
+
+// Opens the movement store specified in the configuration.
+func Open(conf base.Configuration) (MovementStore, error) {
+	switch conf.Store {
+	case "", "postgis":
+		return openPostGIS(conf)
+	case "csv":
+		return newFileStore(conf.StoreFile, csvFormat{})
+	case "geojson":
+		return newFileStore(conf.StoreFile, geoJSONFormat{})
+	case "geoparquet":
+		return newFileStore(conf.StoreFile, geoParquetFormat{})
+	case "sqlite":
+		return openSQLite(conf.StoreFile)
+	default:
+		return nil, errors.New("unknown store '" + conf.Store +
+			"', use one of {'postgis', 'sqlite', 'csv', 'geojson', 'geoparquet'}")
+	}
+}
+
+// A file format a file store can read and write.
+type fileFormat interface {
+	write(filename string, routes []base.Route) error
+	read(filename string) ([]base.Route, error)
+}
+
+// A store backed by a single file. The routes are read into memory on the first query.
+type fileStore struct {
+	filename string
+	format   fileFormat
+	routes   []base.Route
+	loaded   bool
+}
+
+// Creates a store backed by the given file.
+func newFileStore(filename string, format fileFormat) (*fileStore, error) {
+	if filename == "" {
+		return nil, errors.New("file-backed stores require 'storeFile' to be set")
+	}
+	return &fileStore{filename: filename, format: format}, nil
+}
+
+func (s *fileStore) WriteRoutes(routes []base.Route) error {
+	s.loaded = false
+	return s.format.write(s.filename, routes)
+}
+
+// Files are not indexed, but sorted by pickup time when they are loaded.
+func (s *fileStore) CreateIndexes() error {
+	return nil
+}
+
+// Reads the routes from the file, unless this has already been done.
+func (s *fileStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	routes, err := s.format.read(s.filename)
+	if err != nil {
+		return err
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].PuTime.Before(routes[j].PuTime) })
+	s.routes = routes
+	s.loaded = true
+	return nil
+}
+
+func (s *fileStore) GetRoutes(windowStart time.Time, windowEnd time.Time, ids []int64) ([]base.Route, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	routes := make([]base.Route, 0)
+	for _, r := range s.routes {
+		if !r.PuTime.Before(windowEnd) {
+			break
+		}
+		if r.DoTime.After(windowStart) && !excluded[r.Id] {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (s *fileStore) TimeRange() (time.Time, time.Time, error) {
+	if err := s.load(); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if len(s.routes) == 0 {
+		return time.Time{}, time.Time{}, errors.New("no routes in " + s.filename)
+	}
+	end := s.routes[0].DoTime
+	for _, r := range s.routes {
+		if r.DoTime.After(end) {
+			end = r.DoTime
+		}
+	}
+	return s.routes[0].PuTime, end, nil
+}
+
+func (s *fileStore) Close() error {
+	s.routes = nil
+	s.loaded = false
+	return nil
+}
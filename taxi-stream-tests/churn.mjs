@@ -0,0 +1,61 @@
+// Start with "node --experimental-modules churn.mjs" or "npm run churn". Requires Node v9+.
+
+/**
+ * This script stresses the connection handling of the streamer: it keeps a number of taxi, client
+ * and TCP connections open, and constantly closes and reopens random ones while messages are streamed.
+ * Run the streamer with the race detector ("go run -race main.go") to find unsafe concurrent access.
+ * Reports the number of connections and received messages every second.
+ */
+import WebSocket from "ws";
+import net from "net";
+
+const host = '127.0.0.1';
+const wsPort = 8082;
+const tcpPort = 8083;
+const connectionsPerKind = 20;
+const reopensPerSec = 50;
+const durationSecs = 60;
+
+let received = 0;
+let opened = 0;
+let errors = 0;
+
+function openWs(path) {
+    const ws = new WebSocket('ws://' + host + ':' + wsPort + path);
+    ws.on('open', () => opened++);
+    ws.on('message', () => received++);
+    ws.on('error', () => errors++);
+    return { close: () => ws.terminate() };
+}
+
+function openTcp() {
+    const socket = net.connect(tcpPort, host, () => opened++);
+    socket.on('data', () => received++);
+    socket.on('error', () => errors++);
+    return { close: () => socket.destroy() };
+}
+
+const kinds = [() => openWs('/ws'), () => openWs('/ws-clients'), () => openWs('/ws?types=taxiLocation&bbox=-74.02,40.70,-73.97,40.77'), openTcp];
+const connections = [];
+kinds.forEach(open => {
+    for (let i = 0; i < connectionsPerKind; i++) {
+        connections.push({ open: open, conn: open() });
+    }
+});
+
+const churn = setInterval(() => {
+    const c = connections[Math.floor(Math.random() * connections.length)];
+    c.conn.close();
+    c.conn = c.open();
+}, 1000 / reopensPerSec);
+
+const report = setInterval(() => {
+    console.log("Opened:", opened, "Received:", received, "Errors:", errors);
+    received = 0;
+}, 1000);
+
+setTimeout(() => {
+    clearInterval(churn);
+    clearInterval(report);
+    connections.forEach(c => c.conn.close());
+}, durationSecs * 1000);
@@ -0,0 +1,45 @@
+// Start with "node --experimental-modules throughput.mjs [targetSpeedPerSecond] [tolerance]" or "npm run throughput".
+// Requires Node v9+.
+
+/**
+ * This script checks that the streamer achieves the configured throughput: it connects to the taxi stream,
+ * ignores the first seconds (while the first window is prepared), and then counts the received messages.
+ * Exits with a non-zero status if the achieved throughput differs from the target by more than the tolerance
+ * (a fraction, default 5%). Use it with the 'constant' and 'poisson' pacing profiles.
+ */
+import WebSocket from "ws";
+
+const host = '127.0.0.1';
+const wsPort = 8082;
+const target = parseFloat(process.argv[2] || '500');
+const tolerance = parseFloat(process.argv[3] || '0.05');
+const warmupSecs = 5;
+const durationSecs = 30;
+
+let received = 0;
+let measuring = false;
+
+const ws = new WebSocket('ws://' + host + ':' + wsPort + '/ws');
+ws.on('message', () => {
+    if (measuring) {
+        received++;
+    }
+});
+ws.on('error', err => {
+    console.log("Error:", err.message);
+    process.exit(2);
+});
+
+ws.on('open', () => {
+    setTimeout(() => {
+        measuring = true;
+        const start = Date.now();
+        setTimeout(() => {
+            const throughput = received / ((Date.now() - start) / 1000);
+            const deviation = Math.abs(throughput - target) / target;
+            console.log("Target:", target, "Achieved:", throughput.toFixed(1), "Deviation:", (deviation * 100).toFixed(2) + "%");
+            ws.terminate();
+            process.exit(deviation <= tolerance ? 0 : 1);
+        }, durationSecs * 1000);
+    }, warmupSecs * 1000);
+});
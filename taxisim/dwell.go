@@ -0,0 +1,64 @@
+package taxisim
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/twpayne/go-polyline"
+	"taxistream/base"
+)
+
+// How dwell times are distributed: {'constant', 'exponential', 'lognormal'}.
+const (
+	dwellConstant    = "constant"
+	dwellExponential = "exponential"
+	dwellLognormal   = "lognormal"
+)
+
+// Checks if a dwell configuration can be sampled from.
+func validateDwell(conf base.DwellConfiguration) error {
+	if conf.Mean < 0 || conf.StdDev < 0 {
+		return errors.New("dwell times must not be negative")
+	}
+	switch conf.Distribution {
+	case "", dwellConstant, dwellExponential:
+	case dwellLognormal:
+		if conf.Mean > 0 && conf.StdDev == 0 {
+			return errors.New("a lognormal dwell time requires a stdDev")
+		}
+	default:
+		return errors.New("unknown dwell distribution '" + conf.Distribution +
+			"', use one of {'constant', 'exponential', 'lognormal'}")
+	}
+	return nil
+}
+
+// Samples how long a taxi stops. Zero if dwelling is off.
+func sampleDwell(conf base.DwellConfiguration) time.Duration {
+	if conf.Mean <= 0 {
+		return 0
+	}
+	seconds := conf.Mean
+	switch conf.Distribution {
+	case dwellExponential:
+		seconds = rand.ExpFloat64() * conf.Mean
+	case dwellLognormal:
+		// Choose the parameters of the underlying normal distribution such that mean and standard deviation match.
+		sigma2 := math.Log(1 + conf.StdDev*conf.StdDev/(conf.Mean*conf.Mean))
+		seconds = math.Exp(math.Log(conf.Mean) - sigma2/2 + math.Sqrt(sigma2)*rand.NormFloat64())
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Creates the movement of a taxi standing at a location while passengers board or alight (as told by the trip type).
+// Its geometry consists of the location twice, so that it is a valid line.
+func createDwellMovement(taxiId int32, start time.Time, end time.Time, lon float64, lat float64,
+	passengerCount int32, tripType int32) TaxiMovement {
+	geometry := polyline.EncodeCoords([][]float64{{lat, lon}, {lat, lon}})
+	return TaxiMovement{taxiId, start, end, occupied, passengerCount,
+		0, end.Sub(start).Seconds(),
+		0, 0, 0, 0, 0, 0, 0, 0,
+		-1, tripType, string(geometry)}
+}
@@ -2,6 +2,7 @@ package taxisim
 
 import (
 	"math"
+	"sort"
 )
 
 // Default earth radius.
@@ -28,12 +29,15 @@ func HaversineDistance(oLon float64, oLat float64, dLon float64, dLat float64) f
 	return float64(earthRadiusMetres * c)
 }
 
-// Computes the Euclidean distance between points.
+// Computes the distance in meters between points, projecting them onto a plane around their mean latitude
+// (equirectangular projection). For distances within a city, this is as accurate as HaversineDistance, but faster.
 func Distance(lon1 float64, lat1 float64, lon2 float64, lat2 float64) float64 {
-	return math.Sqrt((lon1-lon2)*(lon1-lon2) + (lat1-lat2)*(lat1-lat2))
+	x := degreesToRadians(lon2-lon1) * math.Cos(degreesToRadians((lat1+lat2)/2))
+	y := degreesToRadians(lat2 - lat1)
+	return earthRadiusMetres * math.Sqrt(x*x+y*y)
 }
 
-// Computes the (Euclidean) length of a polyline.
+// Computes the length of a polyline in meters.
 func PolylineLength(coords [][]float64) float64 {
 	var totDist float64 = 0
 	for i := 0; i < len(coords)-1; i++ {
@@ -45,24 +49,81 @@ func PolylineLength(coords [][]float64) float64 {
 	return totDist
 }
 
-// Computes a coordinate along a polyline, namely after "dist" into the polyline.
+// Computes a coordinate along a polyline, namely after "dist" meters into the polyline.
 func AlongPolyline(dist float64, coords [][]float64) (float64, float64) {
-	if dist < 0 {
-		return coords[0][1], coords[0][0]
+	lon, lat, _, _ := AlongPolylineSegment(dist, coords, CumulativeLengths(coords))
+	return lon, lat
+}
+
+// Computes the cumulative length in meters of a polyline at each of its coordinates.
+// The last value is the length of the whole polyline.
+func CumulativeLengths(coords [][]float64) []float64 {
+	cumLengths := make([]float64, len(coords))
+	for i := 1; i < len(coords); i++ {
+		c1 := coords[i-1]
+		c2 := coords[i]
+		cumLengths[i] = cumLengths[i-1] + Distance(c1[1], c1[0], c2[1], c2[0])
 	}
-	var totDist float64 = 0
-	for i := 0; i < len(coords)-1; i++ {
-		c1 := coords[i]
-		c2 := coords[i+1]
-		d := Distance(c1[1], c1[0], c2[1], c2[0])
-		if totDist+d > dist {
-			perc := (dist - totDist) / d
-			lon := c1[1] + (c2[1]-c1[1])*perc
-			lat := c1[0] + (c2[0]-c1[0])*perc
-			return lon, lat
-		} else {
-			totDist += d
+	return cumLengths
+}
+
+// Finds the segment of a polyline that lies "dist" meters into it, by binary search over the cumulative lengths
+// computed by CumulativeLengths. Returns the index of the first coordinate of the segment, and how far into
+// the segment dist lies (from 0 to 1).
+func SegmentAt(dist float64, cumLengths []float64) (int, float64) {
+	if dist < 0 || len(cumLengths) < 2 {
+		return 0, 0
+	}
+	i := sort.Search(len(cumLengths), func(i int) bool { return cumLengths[i] > dist })
+	if i == len(cumLengths) {
+		return len(cumLengths) - 2, 1
+	}
+	return i - 1, (dist - cumLengths[i-1]) / (cumLengths[i] - cumLengths[i-1])
+}
+
+// Computes a coordinate along a polyline like AlongPolyline, but finds the segment by binary search
+// over the cumulative lengths computed by CumulativeLengths.
+func AlongPolylineCumulative(dist float64, coords [][]float64, cumLengths []float64) (float64, float64) {
+	lon, lat, _, _ := AlongPolylineSegment(dist, coords, cumLengths)
+	return lon, lat
+}
+
+// Computes a coordinate along a polyline like AlongPolylineCumulative, and additionally returns the index
+// of the segment it lies on (i.e., of the first coordinate of the segment) and the bearing of that segment.
+// For polylines with a single coordinate, the segment is 0 and the bearing is 0.
+func AlongPolylineSegment(dist float64, coords [][]float64, cumLengths []float64) (float64, float64, int, float64) {
+	if len(coords) < 2 {
+		return coords[0][1], coords[0][0], 0, 0
+	}
+	i, perc := SegmentAt(dist, cumLengths)
+	c1 := coords[i]
+	c2 := coords[i+1]
+	lon := c1[1] + (c2[1]-c1[1])*perc
+	lat := c1[0] + (c2[0]-c1[0])*perc
+	return lon, lat, i, Bearing(c1[1], c1[0], c2[1], c2[0])
+}
+
+// Computes the initial bearing from origin to destination in degrees clockwise from north, from 0 to 360.
+func Bearing(oLon float64, oLat float64, dLon float64, dLat float64) float64 {
+	oLat = degreesToRadians(oLat)
+	dLat = degreesToRadians(dLat)
+	chgLon := degreesToRadians(dLon - oLon)
+
+	y := math.Sin(chgLon) * math.Cos(dLat)
+	x := math.Cos(oLat)*math.Sin(dLat) - math.Sin(oLat)*math.Cos(dLat)*math.Cos(chgLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// Checks if a point lies within a polygon, given by its vertices in the same [lat, lon] order as polylines.
+// The polygon does not need to be closed explicitly.
+func PointInPolygon(lon float64, lat float64, polygon [][]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		c1 := polygon[i]
+		c2 := polygon[j]
+		if (c1[0] > lat) != (c2[0] > lat) && lon < c1[1]+(lat-c1[0])*(c2[1]-c1[1])/(c2[0]-c1[0]) {
+			inside = !inside
 		}
 	}
-	return coords[len(coords)-1][1], coords[len(coords)-1][0]
+	return inside
 }
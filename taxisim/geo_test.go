@@ -0,0 +1,124 @@
+package taxisim
+
+import (
+	"math"
+	"testing"
+)
+
+// How close computed distances (in metres) and coordinates (in degrees) must be to the expected ones.
+const (
+	metreTolerance  = 0.01
+	degreeTolerance = 1e-9
+)
+
+// A polyline (in lat/lon order) that goes 1 km north and then 1 km east from Midtown Manhattan.
+func northThenEast() [][]float64 {
+	lat0, lon0 := 40.75, -73.98
+	dLat := 1000 / earthRadiusMetres * 180 / math.Pi
+	lat1 := lat0 + dLat
+	dLon := 1000 / (earthRadiusMetres * math.Cos(degreesToRadians(lat1))) * 180 / math.Pi
+	// The east segment is measured at its mean latitude, which is lat1.
+	return [][]float64{{lat0, lon0}, {lat1, lon0}, {lat1, lon0 + dLon}}
+}
+
+func TestDistanceIsEqualNorthSouthAndEastWest(t *testing.T) {
+	coords := northThenEast()
+	north := Distance(coords[0][1], coords[0][0], coords[1][1], coords[1][0])
+	east := Distance(coords[1][1], coords[1][0], coords[2][1], coords[2][0])
+	if math.Abs(north-1000) > metreTolerance || math.Abs(east-1000) > metreTolerance {
+		t.Errorf("segments of 1 km measure %.3f m (north) and %.3f m (east)", north, east)
+	}
+	// The same number of degrees is shorter east-west than north-south away from the equator.
+	if d := Distance(-73.98, 40.75, -73.97, 40.75); math.Abs(d-Distance(-73.98, 40.75, -73.98, 40.76)) < 100 {
+		t.Errorf("0.01 degrees east measure as much as 0.01 degrees north: %.1f m", d)
+	}
+	if length := PolylineLength(coords); math.Abs(length-2000) > metreTolerance {
+		t.Errorf("polyline of 2 km measures %.3f m", length)
+	}
+}
+
+func TestAlongPolylineSegment(t *testing.T) {
+	coords := northThenEast()
+	cumLengths := CumulativeLengths(coords)
+	start, corner, end := coords[0], coords[1], coords[2]
+	tests := []struct {
+		name     string
+		dist     float64
+		lat, lon float64
+		segment  int
+		bearing  float64
+	}{
+		{"start", 0, start[0], start[1], 0, 0},
+		{"before start", -50, start[0], start[1], 0, 0},
+		{"quarter", 500, (start[0] + corner[0]) / 2, start[1], 0, 0},
+		// Exactly at a vertex, the next segment begins.
+		{"corner", cumLengths[1], corner[0], corner[1], 1, 90},
+		{"three quarters", 1500, corner[0], (corner[1] + end[1]) / 2, 1, 90},
+		{"end", 2000, end[0], end[1], 1, 90},
+		{"past the end", 5000, end[0], end[1], 1, 90},
+	}
+	for _, test := range tests {
+		lon, lat, segment, bearing := AlongPolylineSegment(test.dist, coords, cumLengths)
+		if math.Abs(lat-test.lat) > degreeTolerance || math.Abs(lon-test.lon) > degreeTolerance {
+			t.Errorf("%s: at %.6f, %.6f, want %.6f, %.6f", test.name, lat, lon, test.lat, test.lon)
+		}
+		if segment != test.segment {
+			t.Errorf("%s: on segment %d, want %d", test.name, segment, test.segment)
+		}
+		// The bearing of an east-west segment is not exactly 90 degrees, as it is a rhumb line.
+		if math.Abs(bearing-test.bearing) > 0.01 {
+			t.Errorf("%s: bearing %.4f, want %.4f", test.name, bearing, test.bearing)
+		}
+		alongLon, alongLat := AlongPolyline(test.dist, coords)
+		if alongLon != lon || alongLat != lat {
+			t.Errorf("%s: AlongPolyline differs from AlongPolylineSegment", test.name)
+		}
+	}
+}
+
+func TestSegmentAt(t *testing.T) {
+	cumLengths := []float64{0, 10, 10, 30}
+	tests := []struct {
+		dist    float64
+		segment int
+		perc    float64
+	}{
+		{-1, 0, 0},
+		{0, 0, 0},
+		{5, 0, 0.5},
+		// The zero-length segment 1 is skipped.
+		{10, 2, 0},
+		{25, 2, 0.75},
+		{30, 2, 1},
+		{40, 2, 1},
+	}
+	for _, test := range tests {
+		segment, perc := SegmentAt(test.dist, cumLengths)
+		if segment != test.segment || math.Abs(perc-test.perc) > 1e-12 {
+			t.Errorf("SegmentAt(%v) = %d, %v, want %d, %v", test.dist, segment, perc, test.segment, test.perc)
+		}
+	}
+}
+
+func TestAlongDegeneratePolylines(t *testing.T) {
+	point := [][]float64{{40.75, -73.98}}
+	for _, dist := range []float64{-1, 0, 100} {
+		lon, lat, segment, bearing := AlongPolylineSegment(dist, point, CumulativeLengths(point))
+		if lon != -73.98 || lat != 40.75 || segment != 0 || bearing != 0 {
+			t.Errorf("one-point polyline at %v m: %v, %v, segment %d, bearing %v", dist, lat, lon, segment, bearing)
+		}
+	}
+	if length := PolylineLength(point); length != 0 {
+		t.Errorf("one-point polyline measures %v m", length)
+	}
+
+	// A taxi standing still, as during a dwell stop.
+	still := [][]float64{{40.75, -73.98}, {40.75, -73.98}}
+	cumLengths := CumulativeLengths(still)
+	for _, dist := range []float64{-1, 0, 100} {
+		lon, lat, segment, _ := AlongPolylineSegment(dist, still, cumLengths)
+		if lon != -73.98 || lat != 40.75 || segment != 0 || math.IsNaN(lon) {
+			t.Errorf("zero-length polyline at %v m: %v, %v, segment %d", dist, lat, lon, segment)
+		}
+	}
+}
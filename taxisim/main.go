@@ -7,10 +7,9 @@ import (
 	"io"
 	"time"
 	"strconv"
-	"database/sql"
 
-	_ "github.com/lib/pq"
 	"taxistream/base"
+	"taxistream/storage"
 )
 
 // Wraps the CSV processing functionality.
@@ -59,6 +58,7 @@ func processTaxiRecord(record []string, simulator Simulator) Simulator {
 	doLat, _ := strconv.ParseFloat(record[8], 32)
 
 	passengerCount, _ := strconv.ParseInt(record[9], 10, 32)
+	tripDistance, _ := strconv.ParseFloat(record[10], 64)
 	fareAmount, _ := strconv.ParseFloat(record[11], 32)
 	extra, _ := strconv.ParseFloat(record[12], 32)
 	mtaTax, _ := strconv.ParseFloat(record[13], 32)
@@ -70,83 +70,73 @@ func processTaxiRecord(record []string, simulator Simulator) Simulator {
 	paymentType, _ := strconv.ParseInt(record[19], 10, 32)
 	tripType, _ := strconv.ParseInt(record[20], 10, 32)
 
-	simulator = processRoute(puTime, puLon, puLat, doTime, doLon, doLat, int32(passengerCount), fareAmount, extra,
+	simulator = processRoute(puTime, puLon, puLat, doTime, doLon, doLat, int32(passengerCount), tripDistance, fareAmount, extra,
 		mtaTax, tipAmount, tollsAmount, ehailFee, improvementSurcharge, totalAmount, int32(paymentType),
 		int32(tripType), simulator)
 	return simulator
 }
 
-// Sets up the connection to the database.
-func connectToDatabase(conf base.Configuration) *sql.DB {
-	dataSourceName := fmt.Sprintf("host=%s port=%s dbname=%s sslmode=%s user=%s password=%s",
-		conf.DbHost, conf.DbPort, conf.DbName, conf.DbSSLMode, conf.DbUser, conf.DbPassword)
-	db, err := sql.Open("postgres", dataSourceName)
-	if err != nil {
-		panic(err)
-	}
-	err = db.Ping()
-	if err != nil {
-		panic(err)
+// Converts the taxi movements of a simulation run into the routes persisted by a movement store.
+func movementsToRoutes(taxiMovements []TaxiMovement) []base.Route {
+	routes := make([]base.Route, len(taxiMovements))
+	for idx, taxiMovement := range taxiMovements {
+		routes[idx] = base.Route{Id: int64(idx), TaxiId: taxiMovement.TaxiId,
+			PuTime: taxiMovement.PuTime, DoTime: taxiMovement.DoTime,
+			PassengerCount: taxiMovement.PassengerCount, Distance: taxiMovement.TripDistance,
+			Duration: taxiMovement.TripDuration, FareAmount: taxiMovement.FareAmount, Extra: taxiMovement.Extra,
+			MTATax: taxiMovement.MTATax, TipAmount: taxiMovement.TipAmount, TollsAmount: taxiMovement.TollsAmount,
+			EHailFee: taxiMovement.EhailFee, ImprovementSurcharge: taxiMovement.ImprovementSurcharge,
+			TotalAmount: taxiMovement.TotalAmount, PaymentType: taxiMovement.PaymentType,
+			TripType: taxiMovement.TripType, Geometry: taxiMovement.Geometry}
 	}
-
-	return db
-}
-
-// Sets up the database, including clearing all previously generated taxi routes.
-func setupDatabase(db *sql.DB) {
-	// Ensure we have PostGIS on the table.
-	db.Exec("CREATE EXTENSION IF NOT EXISTS postgis;")
-
-	db.Exec("CREATE SEQUENCE IF NOT EXISTS taxi_routes_id_seq INCREMENT 1 START 1 MINVALUE 1 MAXVALUE 9223372036854775807 CACHE 1;")
-	db.Exec("CREATE TABLE IF NOT EXISTS taxi_routes (id bigint NOT NULL DEFAULT nextval('taxi_routes_id_seq'::regclass), taxi_id integer NOT NULL, pickup_time timestamp without time zone, dropoff_time timestamp without time zone, passenger_count integer, trip_distance double precision, trip_duration double precision, fare_amount double precision, extra double precision, mta_tax double precision, tip_amount double precision, tolls_amount double precision, ehail_fee double precision, improvement_surcharge double precision, total_amount double precision, payment_type integer, trip_type integer, geometry geometry, CONSTRAINT taxi_routes_pkey PRIMARY KEY (id))")
-
-	// Clear the database.
-	db.Exec("TRUNCATE TABLE taxi_routes;")
+	return routes
 }
 
-// Takes the output of a simulation run and writes it to PostGIS.
-func writeSimulatorOutputToDatabase(conf base.Configuration, simulator Simulator) {
-	db := connectToDatabase(conf)
-	setupDatabase(db)
-	defer db.Close()
-
+// Takes the output of a simulation run and writes it to the configured movement store.
+func writeSimulatorOutput(store storage.MovementStore, simulator Simulator) {
 	fmt.Println(simulator.TaxiMovements)
 
-	for idx, taxiMovement := range simulator.TaxiMovements {
-		_, err := db.Exec("INSERT INTO taxi_routes VALUES ($1, $2, $3, $4, $5, $6, $7, $8, "+
-			"$9, $10, $11, $12, $13, $14, $15, $16, $17, ST_LineFromEncodedPolyline($18))",
-			idx, taxiMovement.TaxiId, taxiMovement.PuTime, taxiMovement.DoTime, taxiMovement.PassengerCount,
-			taxiMovement.TripDistance, taxiMovement.TripDuration, taxiMovement.FareAmount, taxiMovement.Extra,
-			taxiMovement.MTATax, taxiMovement.TipAmount, taxiMovement.TollsAmount, taxiMovement.EhailFee,
-			taxiMovement.ImprovementSurcharge, taxiMovement.TotalAmount, taxiMovement.PaymentType,
-			taxiMovement.TripType, taxiMovement.Geometry)
-		if err != nil {
-			panic(err)
-		}
+	err := store.WriteRoutes(movementsToRoutes(simulator.TaxiMovements))
+	if err != nil {
+		panic(err)
 	}
 }
 
-// Create an index on the time columns.
-func indexDatabase(conf base.Configuration) {
-	db := connectToDatabase(conf)
-	defer db.Close()
-
-	db.Exec("CREATE INDEX taxi_routes_pickup_time_idx ON taxi_routes (pickup_time);")
-	db.Exec("CREATE INDEX taxi_routes_dropoff_time_idx ON taxi_routes (dropoff_time);")
-	db.Exec("CREATE INDEX taxi_routes_id_idx ON taxi_routes (id);")
-}
-
 // Runs the simulation, based on a configuration file.
 func RunSim(conf base.Configuration) {
-	simulator := setUpSimulation(conf.NumTaxis)
+	var err error
+	speedModel, err = NewSpeedModel(conf)
+	if err != nil {
+		panic(err)
+	}
+	for _, dwell := range []base.DwellConfiguration{conf.BoardingDwell, conf.AlightingDwell} {
+		if err := validateDwell(dwell); err != nil {
+			panic(err)
+		}
+	}
+	simulator := setUpSimulation(conf)
 	simulator = processTaxiDataCSV(conf.TaxiData[0], conf.MaxRoutes, simulator, processTaxiRecord)
 
 	fmt.Println("Total routes:", simulator.TotalRoutes)
 	fmt.Println("Unresolved routes:", simulator.UnresolvedRoutes)
+	if simulator.ComparedRoutes > 0 {
+		fmt.Printf("Routes whose distance differs from the recorded trip distance by more than %.0f%%: %d of %d (%.1f%%)\n",
+			simulator.DistanceTolerance*100, simulator.DistanceMismatches, simulator.ComparedRoutes,
+			100*float64(simulator.DistanceMismatches)/float64(simulator.ComparedRoutes))
+	}
+
+	store, err := storage.Open(conf)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
 
-	fmt.Println("Writing simulation output to database.")
-	writeSimulatorOutputToDatabase(conf, simulator)
+	fmt.Println("Writing simulation output to store.")
+	writeSimulatorOutput(store, simulator)
 
 	fmt.Println("Creating indexes.")
-	indexDatabase(conf)
+	err = store.CreateIndexes()
+	if err != nil {
+		panic(err)
+	}
 }
@@ -2,17 +2,34 @@ package taxisim
 
 import (
 	"errors"
+	"math"
 	"math/rand"
 	"fmt"
 	"time"
+	"taxistream/base"
 )
 
+// How much the distance of a route may differ from the recorded trip distance by default, see Simulator.
+const defaultTripDistanceTolerance = 0.25
+
 // Defines the current simulator state.
 type Simulator struct {
 	Taxis            []Taxi
 	TaxiMovements    []TaxiMovement
 	TotalRoutes      int64
 	UnresolvedRoutes int64
+
+	// Whether routes with passengers take as long as the recorded trips, instead of what the speed model says.
+	MatchTripDuration bool
+	// How much the distance of a route found by OSRM may differ from the recorded trip distance (relative to the
+	// latter) before it counts as a mismatch. Of the compared routes, DistanceMismatches did.
+	DistanceTolerance  float64
+	ComparedRoutes     int64
+	DistanceMismatches int64
+
+	// How long taxis stop while passengers board and alight.
+	BoardingDwell  base.DwellConfiguration
+	AlightingDwell base.DwellConfiguration
 }
 
 // Given a new route, select a taxi that could serve it.
@@ -36,7 +53,7 @@ func findTaxi(taxis []Taxi, puTime time.Time, puLon float64, puLat float64) (*Ta
 // Determines if a taxi could reach a given route (pickup location).
 func canReach(taxi Taxi, puTime time.Time, puLon float64, puLat float64) bool {
 	return puTime.After(taxi.Time) &&
-		(HaversineDistance(taxi.Lon, taxi.Lat, puLon, puLat) < puTime.Sub(taxi.Time).Seconds()*TaxiSpeed)
+		speedModel.CanDrive(taxi.Time, puTime, HaversineDistance(taxi.Lon, taxi.Lat, puLon, puLat))
 }
 
 // Creates a random taxi movement and updates the taxi to the newest location.
@@ -57,19 +74,24 @@ func createRandomTaxiMovement(taxi Taxi) TaxiMovement {
 }
 
 // Sets up the simulation.
-func setUpSimulation(numTaxis int32) Simulator {
-	taxis := make([]Taxi, numTaxis)
+func setUpSimulation(conf base.Configuration) Simulator {
+	taxis := make([]Taxi, conf.NumTaxis)
 	for i := range taxis {
 		taxis[i].Id = int32(i)
 		taxis[i].Status = inits
 	}
 	taxiMovements := make([]TaxiMovement, 0)
-	return Simulator{taxis, taxiMovements, 0, 0}
+	distanceTolerance := conf.TripDistanceTolerance
+	if distanceTolerance <= 0 {
+		distanceTolerance = defaultTripDistanceTolerance
+	}
+	return Simulator{taxis, taxiMovements, 0, 0, conf.MatchTripDuration, distanceTolerance, 0, 0,
+		conf.BoardingDwell, conf.AlightingDwell}
 }
 
 // Processes a single route and integrates it into the simulator.
 func processRoute(puTime time.Time, puLon float64, puLat float64, doTime time.Time, doLon float64, doLat float64,
-	passengerCount int32, fareAmount float64, extra float64, mtaTax float64, tipAmount float64,
+	passengerCount int32, tripDistance float64, fareAmount float64, extra float64, mtaTax float64, tipAmount float64,
 	tollsAmount float64, ehailFee float64, improvementSurcharge float64, totalAmount float64, paymentType int32,
 	tripType int32, simulator Simulator) Simulator {
 
@@ -89,13 +111,33 @@ func processRoute(puTime time.Time, puLon float64, puLat float64, doTime time.Ti
 		return simulator
 	}
 
+	// Check if OSRM found about the route the taximeter recorded (trip distances are in miles).
+	if tripDistance > 0 {
+		simulator.ComparedRoutes += 1
+		recorded := tripDistance * metresPerMile
+		if math.Abs(route.Distance-recorded) > simulator.DistanceTolerance*recorded {
+			simulator.DistanceMismatches += 1
+		}
+	}
+	// The taxi then drives the route slower or faster than the speed model says, just as fast as the real one.
+	if simulator.MatchTripDuration && doTime.After(puTime) {
+		route.DoTime = doTime
+	}
+
+	// Passengers board before the taximeter starts, so the taxi has to be at the pickup location a bit earlier
+	// (but it cannot be there before it is free).
+	boardingStart := route.PuTime.Add(-sampleDwell(simulator.BoardingDwell))
+	if boardingStart.Before(taxi.Time) {
+		boardingStart = taxi.Time
+	}
+
 	if taxi.Status != inits {
 		drivingRoute, err := resolveRoute(taxi.Time, taxi.Lon, taxi.Lat, route.PuLon, route.PuLat)
 		if err != nil {
 			panic(err)
 		}
 		timeBudget := taxi.Time.Sub(route.PuTime).Seconds()
-		drivingDurationHigh := drivingRoute.Distance / TaxiSpeed * 1.1
+		drivingDurationHigh := drivingRoute.DoTime.Sub(drivingRoute.PuTime).Seconds() * 1.1
 
 		// If the time to drive from the current position to the pickup location of the taxi is very large,
 		// we simply let this taxi drive around a bit.
@@ -111,17 +153,22 @@ func processRoute(puTime time.Time, puLon float64, puLat float64, doTime time.Ti
 				panic(err)
 			}
 			timeBudget = taxi.Time.Sub(route.PuTime).Seconds()
-			drivingDurationHigh = drivingRoute.Distance / TaxiSpeed * 1.1
+			drivingDurationHigh = drivingRoute.DoTime.Sub(drivingRoute.PuTime).Seconds() * 1.1
 		}
 
 		// Once it is close enough, route to the route pickup location.
 		simulator.TaxiMovements = append(simulator.TaxiMovements,
-			TaxiMovement{taxi.Id, taxi.Time, route.PuTime, free, 0,
-				drivingRoute.Distance, route.PuTime.Sub(drivingRoute.PuTime).Seconds(),
+			TaxiMovement{taxi.Id, taxi.Time, boardingStart, free, 0,
+				drivingRoute.Distance, boardingStart.Sub(drivingRoute.PuTime).Seconds(),
 				0, 0, 0, 0, 0, 0, 0, 0,
 				-1, -1, drivingRoute.Geometry})
 	}
 
+	if boardingStart.Before(route.PuTime) {
+		simulator.TaxiMovements = append(simulator.TaxiMovements, createDwellMovement(taxi.Id, boardingStart,
+			route.PuTime, route.PuLon, route.PuLat, passengerCount, base.TripTypeBoarding))
+	}
+
 	// Finally, write the real route back to the simulator, and update all taxi variables.
 	simulator.TaxiMovements = append(simulator.TaxiMovements,
 		TaxiMovement{taxi.Id, route.PuTime, route.DoTime, occupied,
@@ -129,8 +176,15 @@ func processRoute(puTime time.Time, puLon float64, puLat float64, doTime time.Ti
 			fareAmount, extra, mtaTax, tipAmount, tollsAmount,
 			ehailFee, improvementSurcharge, totalAmount, paymentType,
 			tripType, route.Geometry})
+
+	// After the taximeter stops, the passengers still need some time to get out.
+	alightingEnd := route.DoTime.Add(sampleDwell(simulator.AlightingDwell))
+	if alightingEnd.After(route.DoTime) {
+		simulator.TaxiMovements = append(simulator.TaxiMovements, createDwellMovement(taxi.Id, route.DoTime,
+			alightingEnd, route.DoLon, route.DoLat, passengerCount, base.TripTypeAlighting))
+	}
 	taxi.Status = free
-	taxi.Time = route.DoTime
+	taxi.Time = alightingEnd
 	taxi.Lon = route.DoLon
 	taxi.Lat = route.DoLat
 
@@ -9,6 +9,9 @@ import (
 // Here, we assume an average taxi speed of 2.222 m/s.
 var TaxiSpeed = 2.222
 
+// How fast taxis drive at which time of the day, set up by RunSim. By default, always at TaxiSpeed.
+var speedModel = constantSpeedModel(TaxiSpeed)
+
 // Defines a route as used within this application.
 type Route struct {
 	PuLon    float64
@@ -72,6 +75,6 @@ func resolveRoute(puTime time.Time, puLon, puLat, doLon, doLat float64) (*Route,
 	}
 	return &Route{decodedCoords[0][1], decodedCoords[0][0], puTime,
 		decodedCoords[len(decodedCoords)-1][1], decodedCoords[len(decodedCoords)-1][0],
-		puTime.Add(time.Second * time.Duration(float64(route.Routes[0].Distance)/TaxiSpeed)),
+		puTime.Add(speedModel.TravelTime(puTime, float64(route.Routes[0].Distance), float64(route.Routes[0].Duration))),
 		float64(route.Routes[0].Distance), route.Routes[0].Geometry}, nil
 }
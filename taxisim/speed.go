@@ -0,0 +1,236 @@
+package taxisim
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"taxistream/base"
+)
+
+// How fast taxis drive depending on the time of day: {'constant', 'hourly', 'learned'}.
+const (
+	speedConstant = "constant"
+	speedHourly   = "hourly"
+	speedLearned  = "learned"
+)
+
+// How fast taxis drive in each hour of a typical weekday in New York, relative to the average. Taxis are fastest
+// at night and slowest during the morning and afternoon rush hours.
+var typicalHourlySpeedFactors = []float64{
+	1.30, 1.35, 1.40, 1.45, 1.45, 1.35, 1.15, 0.90, 0.80, 0.85, 0.90, 0.90,
+	0.90, 0.90, 0.85, 0.80, 0.78, 0.78, 0.82, 0.92, 1.02, 1.10, 1.15, 1.22}
+
+// The speed OSRM assumes on an average road in the city (about 30 km/h), to find out whether a route leads along
+// faster or slower roads. How much faster or slower a road class is, is limited by the min and max factors.
+const (
+	osrmReferenceSpeed = 8.33
+	minRoadClassFactor = 0.5
+	maxRoadClassFactor = 2.0
+)
+
+// Trips that are too short or too fast (e.g., due to broken taximeters) are not used to learn the speed model.
+const (
+	minLearnedTripDuration = 60.0
+	maxLearnedTripDuration = 3 * 3600.0
+	maxLearnedTripSpeed    = 40.0
+	// Hours with fewer trips than this keep the average speed.
+	minLearnedTripsPerHour = 10
+)
+
+// The metres per mile, as trip distances in the taxi data are given in miles.
+const metresPerMile = 1609.344
+
+// A model of how fast taxis drive. The speed only depends on the hour of the day (in the time zone of the taxi data),
+// and optionally on the class of the roads a route leads along.
+type SpeedModel struct {
+	// The average speed in m/s.
+	BaseSpeed float64
+	// The speed in each hour of the day, relative to the base speed. The factors average to 1.
+	HourlyFactors [24]float64
+	// Whether routes along faster roads are driven faster, see TravelTime.
+	ByRoadClass bool
+}
+
+// Creates the speed model given in the configuration. A learned model is learned from the first file of TaxiData.
+func NewSpeedModel(conf base.Configuration) (*SpeedModel, error) {
+	factors := make([]float64, 24)
+	for i := range factors {
+		factors[i] = 1
+	}
+	switch conf.SpeedModel {
+	case "", speedConstant:
+	case speedHourly:
+		copy(factors, typicalHourlySpeedFactors)
+		if conf.HourlySpeedFactors != nil {
+			if len(conf.HourlySpeedFactors) != 24 {
+				return nil, errors.New("hourlySpeedFactors must contain 24 values, one for every hour")
+			}
+			copy(factors, conf.HourlySpeedFactors)
+		}
+	case speedLearned:
+		if len(conf.TaxiData) == 0 {
+			return nil, errors.New("a learned speed model requires taxiData")
+		}
+		learned, err := learnHourlySpeedFactors(conf.TaxiData[0], conf.MaxRoutes)
+		if err != nil {
+			return nil, err
+		}
+		factors = learned
+	default:
+		return nil, errors.New("unknown speedModel '" + conf.SpeedModel + "', use one of {'constant', 'hourly', 'learned'}")
+	}
+
+	model := &SpeedModel{BaseSpeed: TaxiSpeed, ByRoadClass: conf.SpeedByRoadClass}
+	mean := 0.0
+	for _, f := range factors {
+		if f <= 0 {
+			return nil, errors.New("speed factors must be positive")
+		}
+		mean += f / 24
+	}
+	for h, f := range factors {
+		model.HourlyFactors[h] = f / mean
+	}
+	return model, nil
+}
+
+// Creates a speed model in which taxis always drive at the given speed (in m/s).
+func constantSpeedModel(speed float64) *SpeedModel {
+	model := &SpeedModel{BaseSpeed: speed}
+	for h := range model.HourlyFactors {
+		model.HourlyFactors[h] = 1
+	}
+	return model
+}
+
+// Learns how fast taxis drive in each hour of the day from the recorded trip distances and durations in a
+// taxi data CSV file (relative to the average over all hours). Reads at most maxRoutes trips (all if -1).
+func learnHourlySpeedFactors(filename string, maxRoutes int32) ([]float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Read()
+	speeds := make([][]float64, 24)
+	for lineCount := int32(0); maxRoutes == -1 || lineCount < maxRoutes; lineCount++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		puTime, err1 := time.Parse("2006-01-02 15:04:05", record[1])
+		doTime, err2 := time.Parse("2006-01-02 15:04:05", record[2])
+		miles, err3 := strconv.ParseFloat(record[10], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		duration := doTime.Sub(puTime).Seconds()
+		speed := miles * metresPerMile / duration
+		if duration < minLearnedTripDuration || duration > maxLearnedTripDuration || speed <= 0 ||
+			speed > maxLearnedTripSpeed {
+			continue
+		}
+		speeds[puTime.Hour()] = append(speeds[puTime.Hour()], speed)
+	}
+
+	// The median is robust against the many trips with implausible distances or durations.
+	medians := make([]float64, 24)
+	total := 0.0
+	hours := 0.0
+	for h, s := range speeds {
+		if len(s) >= minLearnedTripsPerHour {
+			sort.Float64s(s)
+			medians[h] = s[len(s)/2]
+			total += medians[h]
+			hours += 1
+		}
+	}
+	if hours == 0 {
+		return nil, errors.New("not enough trips in " + filename + " to learn a speed model")
+	}
+	factors := make([]float64, 24)
+	for h, m := range medians {
+		factors[h] = 1
+		if m > 0 {
+			factors[h] = m / (total / hours)
+		}
+	}
+	fmt.Println("Learned hourly speed factors:", factors)
+	return factors, nil
+}
+
+// How fast taxis drive at time t, relative to the base speed.
+func (model *SpeedModel) Factor(t time.Time) float64 {
+	return model.HourlyFactors[t.UTC().Hour()]
+}
+
+// How far a taxi driving at the base speed of 1 m/s gets from start to end (in m), i.e., the integral of the
+// speed factor over time.
+func (model *SpeedModel) integral(start time.Time, end time.Time) float64 {
+	distance := 0.0
+	for start.Before(end) {
+		hourEnd := start.Truncate(time.Hour).Add(time.Hour)
+		if hourEnd.After(end) {
+			hourEnd = end
+		}
+		distance += model.Factor(start) * hourEnd.Sub(start).Seconds()
+		start = hourEnd
+	}
+	return distance
+}
+
+// The time it takes to drive a route of the given length (in m) starting at start. If the model takes the road
+// class into account, the duration OSRM estimates for the route (in s) tells how fast its roads are.
+func (model *SpeedModel) TravelTime(start time.Time, distance float64, osrmDuration float64) time.Duration {
+	speed := model.BaseSpeed
+	if model.ByRoadClass && osrmDuration > 0 && distance > 0 {
+		speed *= math.Max(minRoadClassFactor, math.Min(distance/osrmDuration/osrmReferenceSpeed, maxRoadClassFactor))
+	}
+	// Drive hour by hour, each at its own speed, until the route is done.
+	t := start
+	remaining := distance
+	for {
+		hourEnd := t.Truncate(time.Hour).Add(time.Hour)
+		hourSpeed := speed * model.Factor(t)
+		if hourSpeed*hourEnd.Sub(t).Seconds() >= remaining {
+			return t.Add(time.Duration(remaining/hourSpeed*float64(time.Second))).Sub(start)
+		}
+		remaining -= hourSpeed * hourEnd.Sub(t).Seconds()
+		t = hourEnd
+	}
+}
+
+// How far a taxi driving from start to end is at time t, as a fraction of its route. The taxi drives
+// at the speed of the model, i.e., covers more of the route in hours with a higher factor.
+func (model *SpeedModel) Progress(start time.Time, end time.Time, t time.Time) float64 {
+	total := model.integral(start, end)
+	if total <= 0 {
+		return 0
+	}
+	return model.integral(start, t) / total
+}
+
+// The speed (in m/s) at time t of a taxi driving a route of the given length (in m) from start to end.
+func (model *SpeedModel) SpeedAt(start time.Time, end time.Time, length float64, t time.Time) float64 {
+	total := model.integral(start, end)
+	if total <= 0 {
+		return 0
+	}
+	return length * model.Factor(t) / total
+}
+
+// Whether a taxi can drive the given distance (in m) between start and end.
+func (model *SpeedModel) CanDrive(start time.Time, end time.Time, distance float64) bool {
+	return model.BaseSpeed*model.integral(start, end) > distance
+}
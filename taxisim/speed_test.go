@@ -0,0 +1,161 @@
+package taxisim
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"taxistream/base"
+)
+
+// A model in which taxis drive 10 m/s, but only half as fast from 8 to 9.
+func rushHourModel() *SpeedModel {
+	model := constantSpeedModel(10)
+	model.HourlyFactors[8] = 0.5
+	return model
+}
+
+func at(hour int, minute int) time.Time {
+	return time.Date(2016, 1, 4, hour, minute, 0, 0, time.UTC)
+}
+
+func TestNewSpeedModel(t *testing.T) {
+	model, err := NewSpeedModel(base.Configuration{SpeedModel: speedHourly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mean := 0.0
+	for _, f := range model.HourlyFactors {
+		mean += f / 24
+	}
+	if math.Abs(mean-1) > 1e-9 || model.Factor(at(3, 0)) <= model.Factor(at(8, 0)) {
+		t.Errorf("hourly factors %v do not average to 1 with faster nights than rush hours", model.HourlyFactors)
+	}
+
+	factors := make([]float64, 24)
+	for i := range factors {
+		factors[i] = 1
+	}
+	factors[0] = 0
+	for _, conf := range []base.Configuration{
+		{SpeedModel: "fast"},
+		{SpeedModel: speedHourly, HourlySpeedFactors: []float64{1, 2}},
+		{SpeedModel: speedHourly, HourlySpeedFactors: factors},
+		{SpeedModel: speedLearned},
+	} {
+		if _, err := NewSpeedModel(conf); err == nil {
+			t.Errorf("speed model %+v was accepted", conf)
+		}
+	}
+}
+
+func TestTravelTime(t *testing.T) {
+	model := rushHourModel()
+	tests := []struct {
+		start    time.Time
+		distance float64
+		want     time.Duration
+	}{
+		{at(7, 0), 6000, 600 * time.Second},
+		{at(8, 0), 6000, 1200 * time.Second},
+		// 9 km at 5 m/s until 9:00, and the remaining 6 km at 10 m/s.
+		{at(8, 30), 15000, 2400 * time.Second},
+		{at(7, 50), 0, 0},
+	}
+	for _, test := range tests {
+		if got := model.TravelTime(test.start, test.distance, 0); got != test.want {
+			t.Errorf("driving %.0f m from %s takes %s, want %s", test.distance, test.start.Format("15:04"), got,
+				test.want)
+		}
+	}
+}
+
+func TestTravelTimeByRoadClass(t *testing.T) {
+	model := constantSpeedModel(10)
+	model.ByRoadClass = true
+	tests := []struct {
+		osrmDuration float64
+		want         time.Duration
+	}{
+		// The OSRM duration is unknown.
+		{0, 1000 * time.Second},
+		// The route is twice as fast as the average road.
+		{10000 / (2 * osrmReferenceSpeed), 500 * time.Second},
+		// The route is much slower than the average road, which is limited to half the speed.
+		{10000 / (0.1 * osrmReferenceSpeed), 2000 * time.Second},
+	}
+	for _, test := range tests {
+		got := model.TravelTime(at(12, 0), 10000, test.osrmDuration)
+		if math.Abs((got - test.want).Seconds()) > 1e-6 {
+			t.Errorf("driving 10 km that OSRM estimates at %.0f s takes %s, want %s", test.osrmDuration, got,
+				test.want)
+		}
+	}
+}
+
+func TestProgressAndSpeed(t *testing.T) {
+	model := rushHourModel()
+	// From 8:30 to 9:10, 900 m are driven (at a speed of 1 m/s) until 9:00, and 600 m after.
+	start, end := at(8, 30), at(9, 10)
+	if progress := model.Progress(start, end, at(9, 0)); math.Abs(progress-0.6) > 1e-9 {
+		t.Errorf("progress at 9:00 is %.3f, want 0.6", progress)
+	}
+	if progress := model.Progress(start, end, end); math.Abs(progress-1) > 1e-9 {
+		t.Errorf("progress at the end is %.3f, want 1", progress)
+	}
+	if speed := model.SpeedAt(start, end, 3000, at(8, 45)); math.Abs(speed-1) > 1e-9 {
+		t.Errorf("speed at 8:45 is %.3f m/s, want 1", speed)
+	}
+	if speed := model.SpeedAt(start, end, 3000, at(9, 5)); math.Abs(speed-2) > 1e-9 {
+		t.Errorf("speed at 9:05 is %.3f m/s, want 2", speed)
+	}
+	if progress := model.Progress(start, start, start); progress != 0 {
+		t.Errorf("progress of a route without duration is %.3f, want 0", progress)
+	}
+
+	if !model.CanDrive(start, end, 14999) || model.CanDrive(start, end, 15001) {
+		t.Errorf("taxis can drive 15 km from 8:30 to 9:10")
+	}
+}
+
+func TestLearnHourlySpeedFactors(t *testing.T) {
+	var data strings.Builder
+	data.WriteString("VendorID,pickup,dropoff,a,b,c,d,e,f,g,trip_distance\n")
+	trip := func(pickup time.Time, seconds float64, speed float64) {
+		fmt.Fprintf(&data, "2,%s,%s,,,,,,,,%f\n", pickup.Format("2006-01-02 15:04:05"),
+			pickup.Add(time.Duration(seconds)*time.Second).Format("2006-01-02 15:04:05"),
+			speed*seconds/metresPerMile)
+	}
+	for i := 0; i < minLearnedTripsPerHour; i++ {
+		trip(at(3, i), 600, 12)
+		trip(at(15, i), 600, 6)
+		// Implausible trips are left out: too fast, too short, or too long.
+		trip(at(15, i), 600, 2*maxLearnedTripSpeed)
+		trip(at(15, i), minLearnedTripDuration/2, 30)
+		trip(at(15, i), 2*maxLearnedTripDuration, 1)
+	}
+	// Too few trips to learn the speed in this hour.
+	trip(at(20, 0), 600, 1)
+	filename := filepath.Join(t.TempDir(), "trips.csv")
+	if err := os.WriteFile(filename, []byte(data.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	factors, err := learnHourlySpeedFactors(filename, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The speeds are relative to the average of the learned hours, 9 m/s.
+	for h, want := range map[int]float64{3: 12.0 / 9, 15: 6.0 / 9, 20: 1, 0: 1} {
+		if math.Abs(factors[h]-want) > 1e-3 {
+			t.Errorf("speed factor of hour %d is %.3f, want %.3f", h, factors[h], want)
+		}
+	}
+	if _, err := learnHourlySpeedFactors(filename, 5); err == nil {
+		t.Errorf("speed factors were learned from too few trips")
+	}
+}
@@ -0,0 +1,206 @@
+package taxisite
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens to messages for a client whose queue is full: {'drop-oldest', 'drop-newest', 'disconnect'}.
+const (
+	policyDropOldest = "drop-oldest"
+	policyDropNewest = "drop-newest"
+	policyDisconnect = "disconnect"
+)
+
+// The queue size of a client if none is configured.
+const defaultClientQueueSize = 1000
+
+// An encoded message waiting to be sent to a client.
+type outgoing struct {
+	Data      []byte
+	EventTime int64
+	EmitTime  int64
+}
+
+// A consumer of the taxi stream. Every client has its own bounded queue, which is written to its connection
+// by its own goroutine, so that a slow client does not hold up the others.
+type streamClient struct {
+	Id     int64
+	Kind   string
+	Remote string
+	Sub    *subscription
+
+	queue     chan outgoing
+	policy    string
+	write     func(data []byte) error
+	closeConn func() error
+	// Tells the other side that the stream ends, when shutting down. Optional.
+	goodbye   func(deadline time.Time) error
+	done      chan struct{}
+	closeOnce sync.Once
+	// Closed when shutting down, after which the writer sends what is left in the queue until closeDeadline.
+	closing       chan struct{}
+	closingOnce   sync.Once
+	closeDeadline time.Time
+	// Guards writes to the connection, which may also happen outside the writer goroutine.
+	writeMutex sync.Mutex
+
+	// Metrics, accessed atomically.
+	sent          int64
+	dropped       int64
+	lastEventTime int64
+	lastLag       int64
+}
+
+// The metrics of a client, as reported by /metrics/clients. Lag is the time the last sent message waited
+// in the queue, event time lag how far the client is behind the stream in simulated time (both in ms).
+type ClientStats struct {
+	Id           int64  `json:"id"`
+	Stream       string `json:"stream"`
+	Kind         string `json:"kind"`
+	Remote       string `json:"remote"`
+	Encoding     string `json:"encoding"`
+	Queued       int    `json:"queued"`
+	QueueSize    int    `json:"queueSize"`
+	Sent         int64  `json:"sent"`
+	Dropped      int64  `json:"dropped"`
+	LagMs        int64  `json:"lagMs"`
+	EventTimeLag int64  `json:"eventTimeLagMs"`
+}
+
+var clientIds int64 = 0
+
+// Creates a client and starts its writer goroutine. The write function sends a single message over the
+// connection, closeConn closes it. If goodbye is given, it is called before closing the connection when
+// shutting down (but not when the client is disconnected otherwise, since it may block).
+func newStreamClient(kind string, remote string, sub *subscription, queueSize int, policy string,
+	write func(data []byte) error, closeConn func() error, goodbye func(deadline time.Time) error) *streamClient {
+	if queueSize <= 0 {
+		queueSize = defaultClientQueueSize
+	}
+	client := &streamClient{Id: atomic.AddInt64(&clientIds, 1), Kind: kind, Remote: remote, Sub: sub,
+		queue: make(chan outgoing, queueSize), policy: policy, write: write, closeConn: closeConn, goodbye: goodbye,
+		done: make(chan struct{}), closing: make(chan struct{})}
+	go client.run()
+	return client
+}
+
+// Writes queued messages to the connection until the client is closed or a write fails.
+func (client *streamClient) run() {
+	for {
+		select {
+		case m := <-client.queue:
+			if !client.writeQueued(m) {
+				return
+			}
+		case <-client.closing:
+			for len(client.queue) > 0 && time.Now().Before(client.closeDeadline) {
+				if !client.writeQueued(<-client.queue) {
+					return
+				}
+			}
+			if client.goodbye != nil {
+				client.writeMutex.Lock()
+				client.goodbye(client.closeDeadline)
+				client.writeMutex.Unlock()
+			}
+			client.Close()
+			return
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// Writes a queued message to the connection. Returns false (and closes the client) if writing failed.
+func (client *streamClient) writeQueued(m outgoing) bool {
+	client.writeMutex.Lock()
+	err := client.write(m.Data)
+	client.writeMutex.Unlock()
+	if err != nil {
+		select {
+		case <-client.done:
+			// The client was closed while writing, e.g., because it was too slow.
+		default:
+			fmt.Println("Error (writing to client "+client.Remote+"):", err)
+			client.Close()
+		}
+		return false
+	}
+	atomic.AddInt64(&client.sent, 1)
+	atomic.StoreInt64(&client.lastEventTime, m.EventTime)
+	atomic.StoreInt64(&client.lastLag, toMillis(time.Now())-m.EmitTime)
+	return true
+}
+
+// Queues a message for sending. If the queue is full, the slow-consumer policy decides what happens.
+func (client *streamClient) enqueue(m outgoing) {
+	select {
+	case <-client.done:
+		return
+	default:
+	}
+	for {
+		select {
+		case client.queue <- m:
+			return
+		default:
+		}
+		switch client.policy {
+		case policyDropNewest:
+			atomic.AddInt64(&client.dropped, 1)
+			return
+		case policyDisconnect:
+			fmt.Println("Disconnecting slow client", client.Remote)
+			atomic.AddInt64(&client.dropped, 1)
+			client.Close()
+			return
+		default:
+			// Make room by dropping the oldest message, unless the writer just did so.
+			select {
+			case <-client.queue:
+				atomic.AddInt64(&client.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// Stops the writer goroutine and closes the connection. Safe to call multiple times.
+func (client *streamClient) Close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		client.closeConn()
+	})
+}
+
+// Sends the messages left in the queue until the deadline, then closes the client. Returns once it is closed.
+func (client *streamClient) Shutdown(deadline time.Time) {
+	client.closingOnce.Do(func() {
+		client.closeDeadline = deadline
+		close(client.closing)
+	})
+	select {
+	case <-client.done:
+	case <-time.After(time.Until(deadline)):
+		// The client is stalled, so closing the connection makes the pending write fail.
+		client.Close()
+	}
+}
+
+// Reports the current metrics of the client.
+func (client *streamClient) Stats() ClientStats {
+	eventTimeLag := int64(0)
+	if lastEventTime := atomic.LoadInt64(&client.lastEventTime); lastEventTime > 0 {
+		eventTimeLag = atomic.LoadInt64(&streamer.EventTime) - lastEventTime
+	}
+	return ClientStats{client.Id, "", client.Kind, client.Remote, client.Sub.Encoder.Format(), len(client.queue),
+		cap(client.queue), atomic.LoadInt64(&client.sent), atomic.LoadInt64(&client.dropped),
+		atomic.LoadInt64(&client.lastLag), eventTimeLag}
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
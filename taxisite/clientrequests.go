@@ -0,0 +1,249 @@
+package taxisite
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"taxistream/messages"
+	"time"
+)
+
+// Where client requests come from: generated by the streamer, or submitted on the WebSocket or via HTTP.
+const (
+	sourceGenerated = "generated"
+	sourceWebSocket = "ws"
+	sourceHTTP      = "http"
+)
+
+// How large a submitted ride request may be at most, in bytes.
+const maxRideRequestSize = 64 * 1024
+
+// The answer to a submitted ride request. Accepted requests are streamed with the given sequence number.
+type rideRequestReply struct {
+	Accepted  bool   `json:"accepted"`
+	Seq       int64  `json:"seq,omitempty"`
+	RequestId *int64 `json:"requestId,omitempty"`
+	ClientId  *int   `json:"clientId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Records every client request, and what the matcher made of it, in a CSV file for later analysis.
+// Requests are submitted concurrently, so all access is guarded by a lock.
+type clientRequestLog struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+// Creates the client request log, or returns nil if no file is given.
+func newClientRequestLog(filename string) (*clientRequestLog, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	requestLog := &clientRequestLog{file: file, writer: csv.NewWriter(file)}
+	requestLog.writer.Write([]string{"seq", "requestId", "eventTime", "emitTime", "source", "clientId", "origLon", "origLat",
+		"destLon", "destLat", "willShare", "maxWait", "outcome", "taxiId", "eta"})
+	return requestLog, nil
+}
+
+// Records a client request and the assignment or rejection of the matcher (nil without matcher).
+func (requestLog *clientRequestLog) Record(envelope *messages.Envelope, source string, outcome *messages.Envelope) {
+	request := envelope.Payload.(*messages.ClientRequestUpdate)
+	line := []string{strconv.FormatInt(envelope.Ts.Seq, 10), strconv.FormatInt(request.RequestId, 10),
+		strconv.FormatInt(envelope.Ts.EventTime, 10), strconv.FormatInt(envelope.Ts.EmitTime, 10), source, strconv.Itoa(request.ClientId),
+		strconv.FormatFloat(request.OrigLon, 'f', -1, 64), strconv.FormatFloat(request.OrigLat, 'f', -1, 64),
+		strconv.FormatFloat(request.DestLon, 'f', -1, 64), strconv.FormatFloat(request.DestLat, 'f', -1, 64),
+		strconv.FormatBool(request.WillShare), strconv.FormatFloat(request.MaxWait, 'f', -1, 64), "", "", ""}
+	if outcome != nil {
+		line[12] = outcome.Type
+		if assigned, ok := outcome.Payload.(*messages.RequestAssignedUpdate); ok {
+			line[13] = strconv.Itoa(int(assigned.TaxiId))
+			line[14] = strconv.FormatFloat(assigned.Eta, 'f', 1, 64)
+		}
+	}
+
+	requestLog.mutex.Lock()
+	defer requestLog.mutex.Unlock()
+	if requestLog.writer == nil {
+		return
+	}
+	requestLog.writer.Write(line)
+	requestLog.writer.Flush()
+}
+
+// Closes the log file. Requests recorded afterwards are ignored.
+func (requestLog *clientRequestLog) Close() {
+	requestLog.mutex.Lock()
+	defer requestLog.mutex.Unlock()
+	requestLog.writer.Flush()
+	requestLog.file.Close()
+	requestLog.writer = nil
+}
+
+// Sends a message to all clients of the client request stream. The caller must hold the lock, so that
+// the sequence numbers are in order.
+func (clientRequestStreamer *ClientRequestStreamer) send(envelope *messages.Envelope) {
+	envelope.Stamp(time.Now(), atomic.AddInt64(&clientRequestStreamer.Seq, 1))
+	encoded := make(map[string][]byte, 3)
+	clientRequestStreamer.Clients.Broadcast(func(client *streamClient) {
+		// Client requests and assignments carry their own location, so no taxi positions are needed to filter them.
+		send(client, envelope, nil, encoded)
+	})
+}
+
+// Streams a new client request made at time t with its created status, lets the matcher (if enabled) serve it,
+// and records both. If the client ID is negative, a client without an open request is picked.
+func (clientRequestStreamer *ClientRequestStreamer) publish(request *messages.ClientRequestUpdate, t time.Time,
+	source string) *messages.Envelope {
+	clientRequestStreamer.mutex.Lock()
+	defer clientRequestStreamer.mutex.Unlock()
+	if request.ClientId < 0 {
+		request.ClientId = clientRequestStreamer.tracker.idleClient(clientRequestStreamer.MaxClients)
+	}
+	status := clientRequestStreamer.tracker.Create(request, t)
+	envelope := messages.NewEnvelope(request, t)
+	clientRequestStreamer.send(envelope)
+	clientRequestStreamer.send(status)
+	clientRequestStreamer.serve(envelope, t, source)
+	return envelope
+}
+
+// Streams the update of a client request that is still waiting for a taxi at time t with its updated status,
+// and lets the matcher (if enabled) serve it again.
+func (clientRequestStreamer *ClientRequestStreamer) update(request *messages.ClientRequestUpdate, t time.Time,
+	source string) (*messages.Envelope, error) {
+	clientRequestStreamer.mutex.Lock()
+	defer clientRequestStreamer.mutex.Unlock()
+	status, err := clientRequestStreamer.tracker.Update(request, t)
+	if err != nil {
+		return nil, err
+	}
+	envelope := messages.NewEnvelope(request, t)
+	clientRequestStreamer.send(envelope)
+	clientRequestStreamer.send(status)
+	clientRequestStreamer.serve(envelope, t, source)
+	return envelope, nil
+}
+
+// Lets the matcher (if enabled) serve a client request just sent, and records both. The caller must hold the lock.
+func (clientRequestStreamer *ClientRequestStreamer) serve(envelope *messages.Envelope, t time.Time, source string) {
+	request := envelope.Payload.(*messages.ClientRequestUpdate)
+	var outcome *messages.Envelope = nil
+	if streamer.Matcher != nil {
+		outcome = streamer.Matcher.Match(request, t)
+		clientRequestStreamer.send(outcome)
+		if assigned, ok := outcome.Payload.(*messages.RequestAssignedUpdate); ok {
+			clientRequestStreamer.send(clientRequestStreamer.tracker.Matched(request.RequestId, assigned.TaxiId,
+				assigned.Eta, t, streamer.Matcher.Speeds))
+		}
+	}
+	if clientRequestStreamer.Log != nil {
+		clientRequestStreamer.Log.Record(envelope, source, outcome)
+	}
+}
+
+// Cancels a client request at time t, and streams the cancelled status.
+func (clientRequestStreamer *ClientRequestStreamer) cancel(requestId int64, t time.Time) (*messages.Envelope, error) {
+	clientRequestStreamer.mutex.Lock()
+	defer clientRequestStreamer.mutex.Unlock()
+	status, err := clientRequestStreamer.tracker.Cancel(requestId, t)
+	if err != nil {
+		return nil, err
+	}
+	clientRequestStreamer.send(status)
+	return status, nil
+}
+
+// Streams the status changes of the client requests due until time t.
+func (clientRequestStreamer *ClientRequestStreamer) advance(t time.Time) {
+	clientRequestStreamer.mutex.Lock()
+	defer clientRequestStreamer.mutex.Unlock()
+	for _, status := range clientRequestStreamer.tracker.Advance(t) {
+		clientRequestStreamer.send(status)
+	}
+}
+
+// Streams a ride request submitted by a client at the current time of the replay: a new client request,
+// the update of a waiting one, or the cancellation of an open one, as given by its request ID.
+func (clientRequestStreamer *ClientRequestStreamer) submit(r *messages.RideRequest, source string) rideRequestReply {
+	t := replayClock()
+	if r.RequestId != nil && r.Cancel {
+		status, err := clientRequestStreamer.cancel(*r.RequestId, t)
+		if err != nil {
+			return rideRequestReply{Error: err.Error()}
+		}
+		clientId := status.Payload.(*messages.ClientRequestStatusUpdate).ClientId
+		return rideRequestReply{Accepted: true, Seq: status.Ts.Seq, RequestId: r.RequestId, ClientId: &clientId}
+	}
+
+	request := &messages.ClientRequestUpdate{OrigLon: r.OrigLon, OrigLat: r.OrigLat, DestLon: r.DestLon,
+		DestLat: r.DestLat, WillShare: r.WillShare, MaxWait: r.MaxWait}
+	var envelope *messages.Envelope = nil
+	if r.RequestId != nil {
+		request.RequestId = *r.RequestId
+		var err error
+		envelope, err = clientRequestStreamer.update(request, t, source)
+		if err != nil {
+			return rideRequestReply{Error: err.Error()}
+		}
+	} else {
+		request.ClientId = -1
+		if r.ClientId != nil {
+			request.ClientId = *r.ClientId
+		}
+		envelope = clientRequestStreamer.publish(request, t, source)
+	}
+	return rideRequestReply{Accepted: true, Seq: envelope.Ts.Seq, RequestId: &request.RequestId,
+		ClientId: &request.ClientId}
+}
+
+// Handles a message sent on the client request WebSocket, which must be a ride request. Answers whether
+// it was accepted.
+func handleRideRequestMessage(p []byte) []byte {
+	reply := rideRequestReply{}
+	request, err := messages.DecodeRideRequest(p)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply = clientRequestStreamer.submit(request, sourceWebSocket)
+	}
+	b, _ := json.Marshal(reply)
+	return b
+}
+
+// Accepts ride requests POSTed as JSON, see messages/schema/rideRequest.schema.json.
+func clientRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Ride requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRideRequestSize))
+	var request *messages.RideRequest = nil
+	if err == nil {
+		request, err = messages.DecodeRideRequest(body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(rideRequestReply{Error: err.Error()})
+		return
+	}
+	reply := clientRequestStreamer.submit(request, sourceHTTP)
+	if reply.Accepted {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		// The request to update or cancel is not open (anymore).
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(reply)
+}
@@ -0,0 +1,164 @@
+package taxisite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The state of the replay, as reported by the control endpoints.
+type ReplayStatus struct {
+	Paused      bool      `json:"paused"`
+	WindowStart time.Time `json:"windowStart"`
+	WindowEnd   time.Time `json:"windowEnd"`
+	ReplayStart time.Time `json:"replayStart"`
+	ReplayEnd   time.Time `json:"replayEnd"`
+	TimeWarp    float64   `json:"timeWarp"`
+	TargetSpeed float64   `json:"targetSpeed"`
+	Queued      int       `json:"queued"`
+}
+
+// Registers the endpoints that control the replay at runtime. All of them respond with the replay status.
+// Endpoints that change the replay must be POSTed.
+func exposeControlEndpoints() {
+	http.HandleFunc("/control/status", controlStatusHandler)
+	http.HandleFunc("/control/pause", controlPauseHandler)
+	http.HandleFunc("/control/resume", controlResumeHandler)
+	http.HandleFunc("/control/seek", controlSeekHandler)
+	http.HandleFunc("/control/speed", controlSpeedHandler)
+}
+
+// Writes the current replay state as response.
+func writeReplayStatus(w http.ResponseWriter) {
+	trackpointPrepper.mutex.Lock()
+	status := ReplayStatus{streamer.IsPaused(), trackpointPrepper.WindowStart, trackpointPrepper.WindowEnd,
+		trackpointPrepper.ReplayStart, trackpointPrepper.ReplayEnd, trackpointPrepper.TimeWarp,
+		trackpointPrepper.TargetSpeed, len(*streamer.TaxiupdateChannel)}
+	trackpointPrepper.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Rejects requests that would change the replay but are not POSTed. Returns whether the request was rejected.
+func rejectUnlessPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return false
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "Control requests must be POSTed", http.StatusMethodNotAllowed)
+	return true
+}
+
+func controlStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeReplayStatus(w)
+}
+
+// Stops sending messages. The replay does not advance until it is resumed.
+func controlPauseHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectUnlessPost(w, r) {
+		return
+	}
+	streamer.SetPaused(true)
+	fmt.Println("Control: paused.")
+	writeReplayStatus(w)
+}
+
+func controlResumeHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectUnlessPost(w, r) {
+		return
+	}
+	streamer.SetPaused(false)
+	fmt.Println("Control: resumed.")
+	writeReplayStatus(w)
+}
+
+// Moves the replay to the simulated time t (formatted as "2006-01-02 15:04:05" or RFC 3339).
+func controlSeekHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectUnlessPost(w, r) {
+		return
+	}
+	param := r.URL.Query().Get("t")
+	t, err := time.Parse(replayTimeFormat, param)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, param)
+	}
+	if err != nil {
+		http.Error(w, "Parameter 't' must be formatted as '"+replayTimeFormat+"' or RFC 3339", http.StatusBadRequest)
+		return
+	}
+
+	trackpointPrepper.mutex.Lock()
+	resetWindow(trackpointPrepper, t)
+	atomic.AddInt64(&trackpointPrepper.generation, 1)
+	seeked := trackpointPrepper.seeked
+	trackpointPrepper.seeked = make(chan struct{})
+	trackpointPrepper.mutex.Unlock()
+
+	// Wakes the preparation up if it waits for space in the queue, and waits until it no longer queues updates
+	// for the previous position before flushing the queue.
+	close(seeked)
+	trackpointPrepper.sendMutex.Lock()
+	flushed := streamer.flush()
+	trackpointPrepper.sendMutex.Unlock()
+	streamer.Pacer.Reset()
+	fmt.Println("Control: seeked to", t, "discarding", flushed, "queued updates.")
+	writeReplayStatus(w)
+}
+
+// Changes the time warp and/or the target speed (in updates per second). The new values apply from the next
+// window on, except that the pacer sends at the new target speed right away.
+func controlSpeedHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectUnlessPost(w, r) {
+		return
+	}
+	timeWarp, err := parseOptionalSpeed(r, "timeWarp")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	targetSpeed, err := parseOptionalSpeed(r, "targetSpeed")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeWarp == 0 && targetSpeed == 0 {
+		http.Error(w, "Parameter 'timeWarp' or 'targetSpeed' is required", http.StatusBadRequest)
+		return
+	}
+
+	trackpointPrepper.mutex.Lock()
+	if timeWarp > 0 {
+		trackpointPrepper.TimeWarp = timeWarp
+	}
+	if targetSpeed > 0 {
+		trackpointPrepper.TargetSpeed = targetSpeed
+	}
+	trackpointPrepper.mutex.Unlock()
+	if timeWarp > 0 {
+		streamer.Pacer.SetTimeWarp(timeWarp)
+		fmt.Println("Control: time warp set to", timeWarp)
+	}
+	if targetSpeed > 0 {
+		streamer.Pacer.SetRate(targetSpeed)
+		fmt.Println("Control: target speed set to", targetSpeed)
+	}
+	writeReplayStatus(w)
+}
+
+// Parses a positive number given as query parameter. Returns 0 if it is not given.
+func parseOptionalSpeed(r *http.Request, name string) (float64, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(param, 64)
+	if err != nil || value <= 0 {
+		return 0, errors.New("Parameter '" + name + "' must be a positive number")
+	}
+	return value, nil
+}
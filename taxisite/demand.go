@@ -0,0 +1,158 @@
+package taxisite
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"taxistream/base"
+	"time"
+)
+
+// Where and when clients request taxis: anywhere in New York at a constant rate, like the recorded trips
+// of the hour, or drawn from a kernel density estimate over them: {'uniform', 'trips', 'kde'}.
+const (
+	demandUniform = "uniform"
+	demandTrips   = "trips"
+	demandKDE     = "kde"
+)
+
+// The standard deviation of the Gaussian kernel around recorded pickups and dropoffs if not configured, in metres.
+const defaultDemandBandwidth = 250.0
+
+// While there is no demand in an hour, the client request generator checks the replay clock this often.
+const demandIdleInterval = time.Second
+
+// The origin and destination of a recorded trip.
+type demandTrip struct {
+	OrigLon float64
+	OrigLat float64
+	DestLon float64
+	DestLat float64
+}
+
+// A model of where and when clients request taxis, learned from the recorded trips. Demand depends on the hour
+// of the day (in the time zone of the taxi data), and follows the replay clock, so that it matches the taxis.
+type demandModel struct {
+	Mode      string
+	Bandwidth float64
+	// The recorded trips starting in each hour of the day.
+	Trips [24][]demandTrip
+	// How many trips start in each hour of the day, relative to the average hour.
+	HourlyFactors [24]float64
+}
+
+// Creates the demand model given in the configuration. Demand other than uniform is learned from the first
+// file of TaxiData (at most MaxRoutes trips).
+func newDemandModel(conf base.Configuration) (*demandModel, error) {
+	model := &demandModel{Mode: conf.ClientDemand, Bandwidth: conf.ClientDemandBandwidth}
+	if model.Bandwidth <= 0 {
+		model.Bandwidth = defaultDemandBandwidth
+	}
+	for h := range model.HourlyFactors {
+		model.HourlyFactors[h] = 1
+	}
+	switch conf.ClientDemand {
+	case "", demandUniform:
+		model.Mode = demandUniform
+		return model, nil
+	case demandTrips, demandKDE:
+	default:
+		return nil, errors.New("unknown clientDemand '" + conf.ClientDemand + "', use one of {'uniform', 'trips', 'kde'}")
+	}
+	if len(conf.TaxiData) == 0 {
+		return nil, errors.New("clientDemand '" + conf.ClientDemand + "' requires taxiData")
+	}
+	if err := model.learn(conf.TaxiData[0], conf.MaxRoutes); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// Reads the pickup times and locations of the recorded trips from a taxi data CSV file.
+// Reads at most maxRoutes trips (all if -1). Trips without valid coordinates are skipped.
+func (model *demandModel) learn(filename string, maxRoutes int32) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Read()
+	total := 0
+	for lineCount := int32(0); maxRoutes == -1 || lineCount < maxRoutes; lineCount++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		puTime, err := time.Parse("2006-01-02 15:04:05", record[1])
+		if err != nil {
+			continue
+		}
+		coords := [4]float64{}
+		valid := true
+		for i, field := range []int{5, 6, 7, 8} {
+			coords[i], err = strconv.ParseFloat(record[field], 64)
+			valid = valid && err == nil && coords[i] != 0
+		}
+		if !valid {
+			continue
+		}
+		h := puTime.Hour()
+		model.Trips[h] = append(model.Trips[h], demandTrip{coords[0], coords[1], coords[2], coords[3]})
+		total += 1
+	}
+	if total == 0 {
+		return errors.New("no trips with valid coordinates in " + filename + " to learn the client demand from")
+	}
+	for h, trips := range model.Trips {
+		model.HourlyFactors[h] = float64(len(trips)) * 24 / float64(total)
+	}
+	fmt.Println("Learned client demand from", total, "trips, hourly factors:", model.HourlyFactors)
+	return nil
+}
+
+// How many clients request taxis at time t, relative to the average.
+func (model *demandModel) Factor(t time.Time) float64 {
+	return model.HourlyFactors[t.UTC().Hour()]
+}
+
+// Draws the origin and destination of a client request at time t.
+func (model *demandModel) Sample(t time.Time) demandTrip {
+	trips := model.Trips[t.UTC().Hour()]
+	if model.Mode == demandUniform || len(trips) == 0 {
+		return demandTrip{randlon(), randlat(), randlon(), randlat()}
+	}
+	trip := trips[rand.Intn(len(trips))]
+	if model.Mode == demandKDE {
+		trip.OrigLon, trip.OrigLat = model.perturb(trip.OrigLon, trip.OrigLat)
+		trip.DestLon, trip.DestLat = model.perturb(trip.DestLon, trip.DestLat)
+	}
+	return trip
+}
+
+// Moves a location by the Gaussian kernel of the density estimate.
+func (model *demandModel) perturb(lon float64, lat float64) (float64, float64) {
+	lat2 := lat + rand.NormFloat64()*model.Bandwidth/metresPerDegree
+	lon2 := lon + rand.NormFloat64()*model.Bandwidth/(metresPerDegree*math.Cos(lat*math.Pi/180))
+	return lon2, lat2
+}
+
+// The current simulated time of the replay: the event time of the last update sent, or the start of the first
+// window while nothing was sent yet.
+func replayClock() time.Time {
+	if eventTime := atomic.LoadInt64(&streamer.EventTime); eventTime > 0 {
+		return time.Unix(0, eventTime*int64(time.Millisecond)).UTC()
+	}
+	trackpointPrepper.mutex.Lock()
+	defer trackpointPrepper.mutex.Unlock()
+	return trackpointPrepper.WindowStart
+}
@@ -0,0 +1,89 @@
+package taxisite
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"taxistream/base"
+)
+
+// Writes taxi data in which 3 trips start from 8 to 9 and one from 20 to 21, along with a trip without coordinates.
+func writeDemandData(t *testing.T) string {
+	var data strings.Builder
+	data.WriteString("VendorID,pickup,dropoff,a,b,pickup_lon,pickup_lat,dropoff_lon,dropoff_lat\n")
+	trip := func(pickup string, coords ...float64) {
+		fmt.Fprintf(&data, "2,%s,,,,%f,%f,%f,%f\n", pickup, coords[0], coords[1], coords[2], coords[3])
+	}
+	trip("2016-01-01 08:05:00", -73.98, 40.75, -73.95, 40.78)
+	trip("2016-01-01 08:15:00", -73.98, 40.75, -73.95, 40.78)
+	trip("2016-01-01 08:45:00", -73.98, 40.75, -73.95, 40.78)
+	trip("2016-01-01 20:00:00", -73.90, 40.70, -73.99, 40.72)
+	trip("2016-01-01 21:00:00", 0, 0, -73.99, 40.72)
+	filename := filepath.Join(t.TempDir(), "trips.csv")
+	if err := os.WriteFile(filename, []byte(data.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func newTestDemand(t *testing.T, conf base.Configuration) *demandModel {
+	model, err := newDemandModel(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model
+}
+
+func TestDemandFollowsRecordedTrips(t *testing.T) {
+	model := newTestDemand(t, base.Configuration{ClientDemand: demandTrips, TaxiData: []string{writeDemandData(t)},
+		MaxRoutes: -1})
+	for hour, want := range map[int]float64{8: 18, 20: 6, 21: 0, 3: 0} {
+		if factor := model.Factor(time.Date(2016, 1, 1, hour, 30, 0, 0, time.UTC)); factor != want {
+			t.Errorf("demand from %d o'clock is %.1f, want %.1f", hour, factor, want)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		trip := model.Sample(time.Date(2016, 1, 1, 20, 10, 0, 0, time.UTC))
+		if trip != (demandTrip{-73.90, 40.70, -73.99, 40.72}) {
+			t.Fatalf("sampled %+v, want the trip recorded from 20 to 21", trip)
+		}
+	}
+}
+
+func TestKDEDemandSpreadsRecordedTrips(t *testing.T) {
+	model := newTestDemand(t, base.Configuration{ClientDemand: demandKDE, ClientDemandBandwidth: 100,
+		TaxiData: []string{writeDemandData(t)}, MaxRoutes: -1})
+	squares := 0.0
+	samples := 2000
+	for i := 0; i < samples; i++ {
+		trip := model.Sample(time.Date(2016, 1, 1, 8, 30, 0, 0, time.UTC))
+		metresNorth := (trip.OrigLat - 40.75) * metresPerDegree
+		metresEast := (trip.OrigLon + 73.98) * metresPerDegree * math.Cos(40.75*math.Pi/180)
+		squares += metresNorth*metresNorth + metresEast*metresEast
+	}
+	if stdDev := math.Sqrt(squares / float64(samples) / 2); stdDev < 90 || stdDev > 110 {
+		t.Errorf("origins are spread by %.1f m (standard deviation), want 100 m", stdDev)
+	}
+}
+
+func TestUniformDemand(t *testing.T) {
+	model := newTestDemand(t, base.Configuration{})
+	if model.Mode != demandUniform || model.Factor(time.Date(2016, 1, 1, 3, 0, 0, 0, time.UTC)) != 1 {
+		t.Errorf("default demand is %s with factor %.1f, want uniform with 1", model.Mode, model.Factor(time.Time{}))
+	}
+	trip := model.Sample(time.Time{})
+	if trip.OrigLon < -74.02 || trip.OrigLon > -73.76 || trip.OrigLat < 40.61 || trip.OrigLat > 40.82 {
+		t.Errorf("sampled origin %.3f, %.3f outside New York", trip.OrigLon, trip.OrigLat)
+	}
+
+	for _, conf := range []base.Configuration{{ClientDemand: "rush"}, {ClientDemand: demandTrips}} {
+		if _, err := newDemandModel(conf); err == nil {
+			t.Errorf("demand model %+v was accepted", conf)
+		}
+	}
+}
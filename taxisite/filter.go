@@ -0,0 +1,155 @@
+package taxisite
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"taxistream/messages"
+	"taxistream/taxisim"
+)
+
+// The messages a connection subscribed to. Criteria that are not set match every message.
+type Filter struct {
+	// Only messages of these types.
+	Types map[string]bool
+	// Only messages concerning these taxis.
+	TaxiIds map[int32]bool
+	// Only messages concerning taxis within this bounding box (minLon, minLat, maxLon, maxLat).
+	BBox []float64
+	// Only messages concerning taxis within this polygon, with vertices in [lat, lon] order like polylines.
+	Polygon [][]float64
+}
+
+// Parses a filter from query parameters, e.g.,
+// "types=taxiLocation,taxiOccupancy&taxiIds=1,2&bbox=-74.02,40.70,-73.97,40.77&polygon=-74.02 40.70,-73.97 40.77,...".
+// Polygon vertices are given as "lon lat" pairs.
+func parseFilter(query url.Values) (*Filter, error) {
+	filter := &Filter{}
+	if param := query.Get("types"); param != "" {
+		filter.Types = make(map[string]bool)
+		for _, t := range strings.Split(param, ",") {
+			if !messages.KnownType(t) {
+				return nil, errors.New("unknown message type '" + t + "' in parameter 'types'")
+			}
+			filter.Types[t] = true
+		}
+	}
+	if param := query.Get("taxiIds"); param != "" {
+		filter.TaxiIds = make(map[int32]bool)
+		for _, id := range strings.Split(param, ",") {
+			taxiId, err := strconv.ParseInt(strings.TrimSpace(id), 10, 32)
+			if err != nil {
+				return nil, errors.New("parameter 'taxiIds' must be a list of integers")
+			}
+			filter.TaxiIds[int32(taxiId)] = true
+		}
+	}
+	if param := query.Get("bbox"); param != "" {
+		bbox, err := parseFloats(strings.Split(param, ","))
+		if err != nil || len(bbox) != 4 || bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+			return nil, errors.New("parameter 'bbox' must be given as 'minLon,minLat,maxLon,maxLat'")
+		}
+		filter.BBox = bbox
+	}
+	if param := query.Get("polygon"); param != "" {
+		for _, vertex := range strings.Split(param, ",") {
+			lonLat, err := parseFloats(strings.Fields(vertex))
+			if err != nil || len(lonLat) != 2 {
+				return nil, errors.New("parameter 'polygon' must be given as 'lon lat,lon lat,...'")
+			}
+			filter.Polygon = append(filter.Polygon, []float64{lonLat[1], lonLat[0]})
+		}
+		if len(filter.Polygon) < 3 {
+			return nil, errors.New("parameter 'polygon' needs at least three vertices")
+		}
+	}
+	return filter, nil
+}
+
+func parseFloats(values []string) ([]float64, error) {
+	floats := make([]float64, len(values))
+	for i, v := range values {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		floats[i] = f
+	}
+	return floats, nil
+}
+
+// Checks if the filter restricts messages by location.
+func (f *Filter) spatial() bool {
+	return f.BBox != nil || f.Polygon != nil
+}
+
+// Checks if a message passes the filter. The taxi positions are needed to filter messages about taxis
+// by location, as only some messages contain the position of their taxi.
+func (f *Filter) Matches(u *messages.Envelope, positions map[int32][2]float64) bool {
+	if f.Types != nil && !f.Types[u.Type] {
+		return false
+	}
+	if f.TaxiIds == nil && !f.spatial() {
+		return true
+	}
+	taxiId, concernsTaxi := taxiIdOf(u)
+	// Messages not concerning a single taxi cannot be filtered by taxi.
+	if concernsTaxi && f.TaxiIds != nil && !f.TaxiIds[taxiId] {
+		return false
+	}
+	if f.spatial() {
+		lon, lat, ok := locationOf(u, positions)
+		if !ok {
+			// Messages without a location (e.g. request status updates) pass, but the ones about a taxi
+			// whose position is not known yet do not.
+			return !concernsTaxi
+		}
+		if f.BBox != nil && (lon < f.BBox[0] || lat < f.BBox[1] || lon > f.BBox[2] || lat > f.BBox[3]) {
+			return false
+		}
+		if f.Polygon != nil && !taxisim.PointInPolygon(lon, lat, f.Polygon) {
+			return false
+		}
+	}
+	return true
+}
+
+// Gets where a message happens: at the origin of client requests, and at the position of the taxi otherwise.
+func locationOf(u *messages.Envelope, positions map[int32][2]float64) (float64, float64, bool) {
+	switch p := u.Payload.(type) {
+	case *messages.ClientRequestUpdate:
+		return p.OrigLon, p.OrigLat, true
+	case *messages.RequestAssignedUpdate:
+		return p.TaxiLon, p.TaxiLat, true
+	}
+	if taxiId, ok := taxiIdOf(u); ok {
+		position, ok := positions[taxiId]
+		return position[0], position[1], ok
+	}
+	return 0, 0, false
+}
+
+// Gets the taxi a message concerns, if any.
+func taxiIdOf(u *messages.Envelope) (int32, bool) {
+	switch p := u.Payload.(type) {
+	case *messages.TaxiUpdate:
+		return p.TaxiId, true
+	case *messages.TaxiOccupancyUpdate:
+		return p.TaxiId, true
+	case *messages.TaxiDestinationUpdate:
+		return p.TaxiId, true
+	case *messages.TaxiReservationUpdate:
+		return p.TaxiId, true
+	case *messages.TaxiRouteCompletedUpdate:
+		return p.TaxiId, true
+	case *messages.PickupStartedUpdate:
+		return p.TaxiId, true
+	case *messages.DropoffCompletedUpdate:
+		return p.TaxiId, true
+	case *messages.RequestAssignedUpdate:
+		return p.TaxiId, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,96 @@
+package taxisite
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"taxistream/messages"
+)
+
+func TestParseFilterRejectsInvalidParameters(t *testing.T) {
+	for _, query := range []string{
+		"types=taxiLocation,unknown",
+		"taxiIds=1,two",
+		"bbox=-74,40.7,-73.9",
+		"bbox=-73.9,40.7,-74,40.8",
+		"polygon=-74 40.7,-73.9 40.7",
+		"polygon=-74 40.7,-73.9,-73.9 40.8",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseFilter(values); err == nil {
+			t.Errorf("filter '%s' was accepted", query)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	location := messages.NewEnvelope(&messages.TaxiUpdate{TaxiId: 1, Lon: -73.98, Lat: 40.75}, now)
+	occupancy := messages.NewEnvelope(&messages.TaxiOccupancyUpdate{TaxiId: 2, NumOccupants: 1}, now)
+	unknownTaxi := messages.NewEnvelope(&messages.TaxiReservationUpdate{TaxiId: 3}, now)
+	request := messages.NewEnvelope(&messages.ClientRequestUpdate{ClientId: 1, OrigLon: -73.98, OrigLat: 40.75}, now)
+	// Taxi 1 and the client are in Midtown, taxi 2 in Brooklyn. Taxi 3 has not sent its location yet.
+	positions := map[int32][2]float64{1: {-73.98, 40.75}, 2: {-73.95, 40.65}}
+
+	tests := []struct {
+		query string
+		want  []bool // whether the location, occupancy, unknown taxi and client request pass
+	}{
+		{"", []bool{true, true, true, true}},
+		{"types=taxiOccupancy,clientRequest", []bool{false, true, false, true}},
+		{"taxiIds=1,3", []bool{true, false, true, true}},
+		{"bbox=-74.02,40.70,-73.97,40.77", []bool{true, false, false, true}},
+		// A triangle around Midtown.
+		{"polygon=-74.0 40.74,-73.96 40.74,-73.98 40.77", []bool{true, false, false, true}},
+		{"polygon=-74.0 40.74,-73.96 40.74,-73.98 40.77&taxiIds=2", []bool{false, false, false, true}},
+		{"bbox=-74.02,40.60,-73.90,40.80&types=taxiLocation", []bool{true, false, false, false}},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		filter, err := parseFilter(values)
+		if err != nil {
+			t.Fatalf("filter '%s' was rejected: %v", test.query, err)
+		}
+		for i, u := range []*messages.Envelope{location, occupancy, unknownTaxi, request} {
+			if got := filter.Matches(u, positions); got != test.want[i] {
+				t.Errorf("filter '%s' matches %s: %v, want %v", test.query, u.Type, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestFilterMatchesClientRequestStream(t *testing.T) {
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	midtown := messages.NewEnvelope(&messages.ClientRequestUpdate{ClientId: 1, OrigLon: -73.98, OrigLat: 40.75,
+		DestLon: -73.95, DestLat: 40.65}, now)
+	brooklyn := messages.NewEnvelope(&messages.ClientRequestUpdate{ClientId: 2, OrigLon: -73.95, OrigLat: 40.65,
+		DestLon: -73.98, DestLat: 40.75}, now)
+	assigned := messages.NewEnvelope(&messages.RequestAssignedUpdate{ClientId: 1, TaxiId: 5, TaxiLon: -73.99,
+		TaxiLat: 40.76}, now)
+	status := messages.NewEnvelope(&messages.ClientRequestStatusUpdate{RequestId: 1, ClientId: 1,
+		Status: messages.StatusCreated, TaxiId: -1}, now)
+
+	tests := []struct {
+		query string
+		want  []bool // whether the requests from Midtown and Brooklyn, the assignment and the status pass
+	}{
+		// Requests are located at their origin, and assignments at the taxi, without any taxi positions.
+		{"bbox=-74.02,40.70,-73.97,40.77", []bool{true, false, true, true}},
+		{"polygon=-74.0 40.74,-73.96 40.74,-73.98 40.77", []bool{true, false, false, true}},
+		{"taxiIds=6", []bool{true, true, false, true}},
+		{"bbox=-74.02,40.60,-73.90,40.70&types=clientRequest", []bool{false, true, false, false}},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		filter, err := parseFilter(values)
+		if err != nil {
+			t.Fatalf("filter '%s' was rejected: %v", test.query, err)
+		}
+		for i, u := range []*messages.Envelope{midtown, brooklyn, assigned, status} {
+			if got := filter.Matches(u, nil); got != test.want[i] {
+				t.Errorf("filter '%s' matches %s %d: %v, want %v", test.query, u.Type, i, got, test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package taxisite
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The clients of a stream. Connection handlers register and unregister clients from their own goroutines,
+// while the stream broadcasts to them, so all access is guarded by a lock.
+type Hub struct {
+	Name    string
+	mutex   sync.RWMutex
+	clients map[*streamClient]bool
+	closed  bool
+}
+
+func newHub(name string) *Hub {
+	return &Hub{Name: name, clients: make(map[*streamClient]bool)}
+}
+
+// Adds a client to the hub. Returns false (and closes the client) if the hub is already closed.
+func (hub *Hub) Register(client *streamClient) bool {
+	hub.mutex.Lock()
+	if hub.closed {
+		hub.mutex.Unlock()
+		client.Close()
+		return false
+	}
+	hub.clients[client] = true
+	count := len(hub.clients)
+	hub.mutex.Unlock()
+	fmt.Println("Serving", count, hub.Name, "clients.")
+	return true
+}
+
+// Removes a client from the hub and closes it. Unregistering a client more than once has no effect.
+func (hub *Hub) Unregister(client *streamClient) {
+	hub.mutex.Lock()
+	_, ok := hub.clients[client]
+	delete(hub.clients, client)
+	count := len(hub.clients)
+	hub.mutex.Unlock()
+	client.Close()
+	if ok {
+		fmt.Println("Serving", count, hub.Name, "clients.")
+	}
+}
+
+// The number of registered clients.
+func (hub *Hub) Len() int {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	return len(hub.clients)
+}
+
+// Calls f for every registered client. Clients cannot be registered or unregistered meanwhile,
+// so f must not block (queueing a message does not).
+func (hub *Hub) Broadcast(f func(client *streamClient)) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	for client := range hub.clients {
+		f(client)
+	}
+}
+
+// Closes all clients and refuses new ones. Messages still queued for the clients are sent for at most
+// the given time.
+func (hub *Hub) Close(timeout time.Duration) {
+	hub.mutex.Lock()
+	hub.closed = true
+	clients := hub.clients
+	hub.clients = make(map[*streamClient]bool)
+	hub.mutex.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	for client := range clients {
+		wg.Add(1)
+		go func(client *streamClient) {
+			defer wg.Done()
+			client.Shutdown(deadline)
+		}(client)
+	}
+	wg.Wait()
+	if len(clients) > 0 {
+		fmt.Println("Closed", len(clients), hub.Name, "clients.")
+	}
+}
@@ -0,0 +1,164 @@
+package taxisite
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A client with a fake connection that counts how often it is closed.
+type fakeConn struct {
+	writes int64
+	closes int64
+}
+
+func newFakeClient(policy string, queueSize int, writeDelay time.Duration) (*streamClient, *fakeConn) {
+	conn := &fakeConn{}
+	client := newStreamClient("test", "fake", nil, queueSize, policy,
+		func(data []byte) error {
+			time.Sleep(writeDelay)
+			atomic.AddInt64(&conn.writes, 1)
+			return nil
+		},
+		func() error {
+			atomic.AddInt64(&conn.closes, 1)
+			return nil
+		}, nil)
+	return client, conn
+}
+
+func TestHubConcurrentRegisterUnregisterBroadcastClose(t *testing.T) {
+	hub := newHub("test")
+	policies := []string{policyDropOldest, policyDropNewest, policyDisconnect}
+
+	var mutex sync.Mutex
+	clients := make(map[*streamClient]*fakeConn)
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		broadcasters.Add(1)
+		go func() {
+			defer broadcasters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				hub.Broadcast(func(client *streamClient) {
+					client.enqueue(outgoing{Data: []byte("m")})
+				})
+			}
+		}()
+	}
+
+	var connections sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		connections.Add(1)
+		go func(seed int64) {
+			defer connections.Done()
+			random := rand.New(rand.NewSource(seed))
+			for j := 0; j < 50; j++ {
+				client, conn := newFakeClient(policies[random.Intn(len(policies))], 1+random.Intn(4),
+					time.Duration(random.Intn(200))*time.Microsecond)
+				mutex.Lock()
+				clients[client] = conn
+				mutex.Unlock()
+				if !hub.Register(client) {
+					continue
+				}
+				time.Sleep(time.Duration(random.Intn(300)) * time.Microsecond)
+				// Some connections are left open until the hub is closed, others are unregistered twice.
+				switch random.Intn(3) {
+				case 0:
+				case 1:
+					hub.Unregister(client)
+				case 2:
+					hub.Unregister(client)
+					hub.Unregister(client)
+				}
+			}
+		}(int64(i))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	hub.Close(50 * time.Millisecond)
+	connections.Wait()
+	close(stop)
+	broadcasters.Wait()
+
+	if n := hub.Len(); n != 0 {
+		t.Errorf("%d clients are still registered after closing the hub", n)
+	}
+	late, lateConn := newFakeClient(policyDropOldest, 1, 0)
+	clients[late] = lateConn
+	if hub.Register(late) {
+		t.Errorf("closed hub accepted a client")
+	}
+	for client, conn := range clients {
+		select {
+		case <-client.done:
+		case <-time.After(time.Second):
+			t.Fatalf("client %d was never closed", client.Id)
+		}
+		if closes := atomic.LoadInt64(&conn.closes); closes != 1 {
+			t.Errorf("connection of client %d was closed %d times", client.Id, closes)
+		}
+	}
+}
+
+func TestHubCloseSendsQueuedMessages(t *testing.T) {
+	hub := newHub("test")
+	client, conn := newFakeClient(policyDropNewest, 10, time.Millisecond)
+	hub.Register(client)
+	hub.Broadcast(func(client *streamClient) {
+		for i := 0; i < 5; i++ {
+			client.enqueue(outgoing{Data: []byte("m")})
+		}
+	})
+	hub.Close(time.Second)
+	if writes := atomic.LoadInt64(&conn.writes); writes != 5 {
+		t.Errorf("%d of 5 queued messages were written before closing", writes)
+	}
+	if closes := atomic.LoadInt64(&conn.closes); closes != 1 {
+		t.Errorf("connection was closed %d times", closes)
+	}
+}
+
+func TestDisconnectingStalledClientDoesNotBlockBroadcast(t *testing.T) {
+	hub := newHub("test")
+	stalled := make(chan struct{})
+	defer close(stalled)
+	goodbyes := int64(0)
+	client := newStreamClient("test", "stalled", nil, 1, policyDisconnect,
+		func(data []byte) error {
+			<-stalled
+			return nil
+		},
+		func() error { return nil },
+		func(deadline time.Time) error {
+			atomic.AddInt64(&goodbyes, 1)
+			return nil
+		})
+	hub.Register(client)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		hub.Broadcast(func(client *streamClient) {
+			client.enqueue(outgoing{Data: []byte("m")})
+		})
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("broadcasting to a stalled client took %v", elapsed)
+	}
+	select {
+	case <-client.done:
+	default:
+		t.Errorf("stalled client was not disconnected")
+	}
+	if atomic.LoadInt64(&goodbyes) != 0 {
+		t.Errorf("disconnected client was sent a goodbye")
+	}
+}
@@ -0,0 +1,249 @@
+package taxisite
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"taxistream/messages"
+	"taxistream/taxisim"
+	"time"
+)
+
+// How long clients wait for a taxi before their request expires if they do not say, in simulated seconds.
+const defaultClientPatience = 600.0
+
+// How often the open client requests are checked against the replay clock.
+const requestTrackingInterval = 100 * time.Millisecond
+
+// How often a client that already has an open request is drawn again when generating a request.
+const idleClientAttempts = 10
+
+// How far the replay clock must go back to count as a jump (when the replay loops or is seeked back), rather
+// than updates arriving slightly out of order.
+const replayJumpThreshold = time.Minute
+
+// Follows client requests through their lifecycle on the replay clock, see messages.StatusCreated: clients may
+// cancel their requests with CancelProbability (at a random time before they would expire), requests expire after
+// their max wait (or Patience), and matched requests are picked up and completed as the matcher estimated.
+// It is used by the client request streamer only, which guards it with its lock.
+type requestTracker struct {
+	Patience          float64
+	CancelProbability float64
+	// Frees the taxis of requests that end (nil without matcher).
+	Matcher *Matcher
+
+	lastId   int64
+	requests map[int64]*trackedRequest
+	// How many open requests every client with any has.
+	clients map[int]int
+	// The replay time the tracker last saw, to notice when the replay jumps back.
+	clock time.Time
+}
+
+// An open client request, and when its next status changes are due.
+type trackedRequest struct {
+	Request *messages.ClientRequestUpdate
+	Status  string
+	TaxiId  int32
+	Created time.Time
+	// When the client cancels the request (zero if never), and when it expires unless it is matched.
+	CancelAt time.Time
+	ExpireAt time.Time
+	// When the taxi picks the client up and completes the trip, once the request is matched.
+	PickupAt   time.Time
+	CompleteAt time.Time
+}
+
+// A status change of a request that is due.
+type statusChange struct {
+	Request *trackedRequest
+	Status  string
+	Time    time.Time
+}
+
+func newRequestTracker(patience float64, cancelProbability float64, matcher *Matcher) *requestTracker {
+	if patience <= 0 {
+		patience = defaultClientPatience
+	}
+	return &requestTracker{Patience: patience, CancelProbability: cancelProbability, Matcher: matcher,
+		requests: make(map[int64]*trackedRequest), clients: make(map[int]int)}
+}
+
+// Draws a client at random, preferring clients without an open request.
+func (tracker *requestTracker) idleClient(maxClients int) int {
+	clientId := rand.Intn(maxClients)
+	for i := 1; i < idleClientAttempts; i++ {
+		if _, ok := tracker.clients[clientId]; !ok {
+			break
+		}
+		clientId = rand.Intn(maxClients)
+	}
+	return clientId
+}
+
+// Moves the due status changes of all open requests along if the replay jumped back in time, so that they
+// happen as long after time t as they would have before. Otherwise, they would not happen until the replay
+// reaches them again. The creation times stay as they are. Forward jumps are taken as time that passed.
+func (tracker *requestTracker) observe(t time.Time) {
+	if !tracker.clock.IsZero() && t.Before(tracker.clock.Add(-replayJumpThreshold)) {
+		jump := t.Sub(tracker.clock)
+		for _, r := range tracker.requests {
+			for _, due := range []*time.Time{&r.CancelAt, &r.ExpireAt, &r.PickupAt, &r.CompleteAt} {
+				if !due.IsZero() {
+					*due = due.Add(jump)
+				}
+			}
+		}
+	}
+	tracker.clock = t
+}
+
+// The status update of a request at time t.
+func (tracker *requestTracker) statusUpdate(r *trackedRequest, t time.Time) *messages.Envelope {
+	return messages.NewEnvelope(&messages.ClientRequestStatusUpdate{RequestId: r.Request.RequestId,
+		ClientId: r.Request.ClientId, Status: r.Status, TaxiId: r.TaxiId, CreatedTime: toMillis(r.Created)}, t)
+}
+
+// Schedules when a waiting request expires, and whether (and when) the client cancels it before.
+func (tracker *requestTracker) schedule(r *trackedRequest, t time.Time) {
+	patience := r.Request.MaxWait
+	if patience <= 0 {
+		patience = tracker.Patience
+	}
+	r.ExpireAt = t.Add(time.Duration(patience * float64(time.Second)))
+	r.CancelAt = time.Time{}
+	if rand.Float64() < tracker.CancelProbability {
+		r.CancelAt = t.Add(time.Duration(rand.Float64() * patience * float64(time.Second)))
+	}
+}
+
+// Starts tracking a request created at time t, which gets a new ID. Returns the status update.
+func (tracker *requestTracker) Create(request *messages.ClientRequestUpdate, t time.Time) *messages.Envelope {
+	tracker.observe(t)
+	tracker.lastId += 1
+	request.RequestId = tracker.lastId
+	r := &trackedRequest{Request: request, Status: messages.StatusCreated, TaxiId: -1, Created: t}
+	tracker.schedule(r, t)
+	tracker.requests[request.RequestId] = r
+	tracker.clients[request.ClientId] += 1
+	return tracker.statusUpdate(r, t)
+}
+
+// Gets a request that is still waiting for a taxi, i.e., can be updated.
+func (tracker *requestTracker) waiting(requestId int64) (*trackedRequest, error) {
+	r, ok := tracker.requests[requestId]
+	if !ok {
+		return nil, errors.New("request " + strconv.FormatInt(requestId, 10) + " is not open")
+	}
+	if r.Status != messages.StatusCreated && r.Status != messages.StatusUpdated {
+		return nil, errors.New("request " + strconv.FormatInt(requestId, 10) + " is already " + r.Status)
+	}
+	return r, nil
+}
+
+// Replaces a request that is still waiting for a taxi at time t. Its patience starts over.
+// Returns the status update.
+func (tracker *requestTracker) Update(request *messages.ClientRequestUpdate, t time.Time) (*messages.Envelope, error) {
+	tracker.observe(t)
+	r, err := tracker.waiting(request.RequestId)
+	if err != nil {
+		return nil, err
+	}
+	request.ClientId = r.Request.ClientId
+	r.Request = request
+	r.Status = messages.StatusUpdated
+	tracker.schedule(r, t)
+	return tracker.statusUpdate(r, t), nil
+}
+
+// Cancels a request at time t, unless the client was already picked up. Returns the status update.
+func (tracker *requestTracker) Cancel(requestId int64, t time.Time) (*messages.Envelope, error) {
+	tracker.observe(t)
+	r, ok := tracker.requests[requestId]
+	if !ok {
+		return nil, errors.New("request " + strconv.FormatInt(requestId, 10) + " is not open")
+	}
+	if r.Status == messages.StatusPickedUp {
+		return nil, errors.New("request " + strconv.FormatInt(requestId, 10) + " is already " + r.Status)
+	}
+	return tracker.close(r, messages.StatusCancelled, t), nil
+}
+
+// Records that the matcher assigned a taxi at time t, which picks the client up after the ETA (in s) and then drives
+// to the destination at the given speeds. Returns the status update.
+func (tracker *requestTracker) Matched(requestId int64, taxiId int32, eta float64, t time.Time,
+	speeds *taxisim.SpeedModel) *messages.Envelope {
+	r := tracker.requests[requestId]
+	r.Status = messages.StatusMatched
+	r.TaxiId = taxiId
+	r.PickupAt = t.Add(time.Duration(eta * float64(time.Second)))
+	distance := taxisim.Distance(r.Request.OrigLon, r.Request.OrigLat, r.Request.DestLon, r.Request.DestLat) *
+		matcherDetourFactor
+	r.CompleteAt = r.PickupAt.Add(speeds.TravelTime(r.PickupAt, distance, 0))
+	return tracker.statusUpdate(r, t)
+}
+
+// Stops tracking a request, which ends with the given status at time t. Returns the status update.
+func (tracker *requestTracker) close(r *trackedRequest, status string, t time.Time) *messages.Envelope {
+	r.Status = status
+	delete(tracker.requests, r.Request.RequestId)
+	if tracker.clients[r.Request.ClientId] -= 1; tracker.clients[r.Request.ClientId] <= 0 {
+		delete(tracker.clients, r.Request.ClientId)
+	}
+	if tracker.Matcher != nil {
+		tracker.Matcher.Release(r.Request.RequestId)
+	}
+	return tracker.statusUpdate(r, t)
+}
+
+// The next status change of a request.
+func (tracker *requestTracker) next(r *trackedRequest) statusChange {
+	switch r.Status {
+	case messages.StatusMatched:
+		if !r.CancelAt.IsZero() && r.CancelAt.Before(r.PickupAt) {
+			return statusChange{r, messages.StatusCancelled, r.CancelAt}
+		}
+		return statusChange{r, messages.StatusPickedUp, r.PickupAt}
+	case messages.StatusPickedUp:
+		return statusChange{r, messages.StatusCompleted, r.CompleteAt}
+	default:
+		if !r.CancelAt.IsZero() && r.CancelAt.Before(r.ExpireAt) {
+			return statusChange{r, messages.StatusCancelled, r.CancelAt}
+		}
+		return statusChange{r, messages.StatusExpired, r.ExpireAt}
+	}
+}
+
+// Applies all status changes due until time now, in the order they happened. Returns the status updates.
+func (tracker *requestTracker) Advance(now time.Time) []*messages.Envelope {
+	tracker.observe(now)
+	updates := make([]*messages.Envelope, 0)
+	for {
+		due := make([]statusChange, 0)
+		for _, r := range tracker.requests {
+			if change := tracker.next(r); !change.Time.After(now) {
+				due = append(due, change)
+			}
+		}
+		if len(due) == 0 {
+			return updates
+		}
+		sort.Slice(due, func(i, j int) bool {
+			if due[i].Time.Equal(due[j].Time) {
+				return due[i].Request.Request.RequestId < due[j].Request.Request.RequestId
+			}
+			return due[i].Time.Before(due[j].Time)
+		})
+		// A pickup is followed by the completion, which may be due as well, so the changes are applied
+		// one after the other until none is due.
+		for _, change := range due {
+			if change.Status == messages.StatusPickedUp {
+				change.Request.Status = messages.StatusPickedUp
+				updates = append(updates, tracker.statusUpdate(change.Request, change.Time))
+			} else {
+				updates = append(updates, tracker.close(change.Request, change.Status, change.Time))
+			}
+		}
+	}
+}
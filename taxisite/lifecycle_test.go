@@ -0,0 +1,190 @@
+package taxisite
+
+import (
+	"testing"
+	"time"
+
+	"taxistream/base"
+	"taxistream/messages"
+	"taxistream/taxisim"
+)
+
+var lifecycleStart = time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+
+// The statuses of the given status updates, in order.
+func statuses(t *testing.T, updates []*messages.Envelope) []string {
+	result := make([]string, 0, len(updates))
+	for _, u := range updates {
+		status, ok := u.Payload.(*messages.ClientRequestStatusUpdate)
+		if !ok {
+			t.Fatalf("got %+v, want a status update", u.Payload)
+		}
+		result = append(result, status.Status)
+	}
+	return result
+}
+
+func expectStatuses(t *testing.T, updates []*messages.Envelope, want ...string) {
+	t.Helper()
+	got := statuses(t, updates)
+	if len(got) != len(want) {
+		t.Fatalf("got statuses %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got statuses %v, want %v", got, want)
+		}
+	}
+}
+
+func after(seconds float64) time.Time {
+	return lifecycleStart.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func TestRequestIsPickedUpAndCompleted(t *testing.T) {
+	speeds, err := taxisim.NewSpeedModel(base.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := newRequestTracker(600, 0, nil)
+	created := tracker.Create(&messages.ClientRequestUpdate{ClientId: 3, OrigLon: -73.98, OrigLat: 40.75,
+		DestLon: -73.95, DestLat: 40.78}, lifecycleStart)
+	expectStatuses(t, []*messages.Envelope{created}, messages.StatusCreated)
+	requestId := created.Payload.(*messages.ClientRequestStatusUpdate).RequestId
+
+	matched := tracker.Matched(requestId, 12, 120, after(10), speeds)
+	if status := matched.Payload.(*messages.ClientRequestStatusUpdate); status.TaxiId != 12 ||
+		status.CreatedTime != toMillis(lifecycleStart) {
+		t.Errorf("matched update is %+v, want taxi 12 and the creation time", status)
+	}
+	expectStatuses(t, tracker.Advance(after(129)))
+	// Once matched, the request no longer expires, and the completion follows the pickup in the same step.
+	updates := tracker.Advance(after(3600))
+	expectStatuses(t, updates, messages.StatusPickedUp, messages.StatusCompleted)
+	if updates[0].Ts.EventTime != toMillis(after(130)) {
+		t.Errorf("pickup happened at %d, want %d", updates[0].Ts.EventTime, toMillis(after(130)))
+	}
+	if _, err := tracker.Cancel(requestId, after(3600)); err == nil {
+		t.Errorf("a completed request could be cancelled")
+	}
+	if len(tracker.requests) != 0 || len(tracker.clients) != 0 {
+		t.Errorf("completed request is still tracked")
+	}
+}
+
+func TestRequestExpiresAfterPatience(t *testing.T) {
+	tracker := newRequestTracker(600, 0, nil)
+	tracker.Create(&messages.ClientRequestUpdate{ClientId: 1}, lifecycleStart)
+	// The client's max wait takes precedence over the patience.
+	tracker.Create(&messages.ClientRequestUpdate{ClientId: 2, MaxWait: 60}, lifecycleStart)
+
+	updates := tracker.Advance(after(60))
+	expectStatuses(t, updates, messages.StatusExpired)
+	if status := updates[0].Payload.(*messages.ClientRequestStatusUpdate); status.ClientId != 2 {
+		t.Errorf("request of client %d expired first, want client 2", status.ClientId)
+	}
+	expectStatuses(t, tracker.Advance(after(599)))
+	expectStatuses(t, tracker.Advance(after(600)), messages.StatusExpired)
+}
+
+func TestUpdateRestartsPatience(t *testing.T) {
+	tracker := newRequestTracker(600, 0, nil)
+	created := tracker.Create(&messages.ClientRequestUpdate{ClientId: 1}, lifecycleStart)
+	requestId := created.Payload.(*messages.ClientRequestStatusUpdate).RequestId
+
+	updated, err := tracker.Update(&messages.ClientRequestUpdate{RequestId: requestId, ClientId: 5}, after(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := updated.Payload.(*messages.ClientRequestStatusUpdate); status.Status != messages.StatusUpdated ||
+		status.ClientId != 1 {
+		t.Errorf("update is %+v, want status updated by client 1", status)
+	}
+	expectStatuses(t, tracker.Advance(after(899)))
+	expectStatuses(t, tracker.Advance(after(900)), messages.StatusExpired)
+
+	if _, err := tracker.Update(&messages.ClientRequestUpdate{RequestId: requestId}, after(900)); err == nil {
+		t.Errorf("an expired request could be updated")
+	}
+}
+
+func TestMatchedRequestCannotBeUpdated(t *testing.T) {
+	speeds, _ := taxisim.NewSpeedModel(base.Configuration{})
+	tracker := newRequestTracker(600, 0, nil)
+	created := tracker.Create(&messages.ClientRequestUpdate{ClientId: 1}, lifecycleStart)
+	requestId := created.Payload.(*messages.ClientRequestStatusUpdate).RequestId
+	tracker.Matched(requestId, 4, 60, lifecycleStart, speeds)
+
+	if _, err := tracker.Update(&messages.ClientRequestUpdate{RequestId: requestId}, after(1)); err == nil {
+		t.Errorf("a matched request could be updated")
+	}
+	// Until the client is picked up, the request can still be cancelled.
+	cancelled, err := tracker.Cancel(requestId, after(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatuses(t, []*messages.Envelope{cancelled}, messages.StatusCancelled)
+	expectStatuses(t, tracker.Advance(after(3600)))
+}
+
+func TestClientsCancelBeforeExpiring(t *testing.T) {
+	tracker := newRequestTracker(600, 1, nil)
+	for i := 0; i < 20; i++ {
+		tracker.Create(&messages.ClientRequestUpdate{ClientId: i}, lifecycleStart)
+	}
+	updates := tracker.Advance(after(600))
+	expectStatuses(t, updates[:1], messages.StatusCancelled)
+	if len(updates) != 20 {
+		t.Fatalf("%d of 20 requests ended", len(updates))
+	}
+	last := int64(0)
+	for _, u := range updates {
+		if status := u.Payload.(*messages.ClientRequestStatusUpdate); status.Status != messages.StatusCancelled {
+			t.Errorf("request %d is %s, want cancelled", status.RequestId, status.Status)
+		}
+		if u.Ts.EventTime < last {
+			t.Errorf("status updates are out of order")
+		}
+		last = u.Ts.EventTime
+	}
+}
+
+func TestClientsWithSeveralOpenRequests(t *testing.T) {
+	tracker := newRequestTracker(600, 0, nil)
+	first := tracker.Create(&messages.ClientRequestUpdate{ClientId: 0, MaxWait: 60}, lifecycleStart)
+	tracker.Create(&messages.ClientRequestUpdate{ClientId: 0}, lifecycleStart)
+	firstId := first.Payload.(*messages.ClientRequestStatusUpdate).RequestId
+
+	if _, err := tracker.Cancel(firstId, after(1)); err != nil {
+		t.Fatal(err)
+	}
+	// The client still has its second request open, so it is not idle.
+	if tracker.idleClient(1) != 0 || tracker.clients[0] != 1 {
+		t.Errorf("client has %d open requests, want 1", tracker.clients[0])
+	}
+	tracker.Advance(after(600))
+	if _, ok := tracker.clients[0]; ok {
+		t.Errorf("client without open requests is not idle")
+	}
+}
+
+func TestRequestsMoveAlongWhenReplayJumpsBack(t *testing.T) {
+	tracker := newRequestTracker(600, 0, nil)
+	tracker.Create(&messages.ClientRequestUpdate{ClientId: 1}, after(3600))
+	expectStatuses(t, tracker.Advance(after(3900)))
+
+	// The replay loops back an hour: the request still expires 300 s later, not when the replay gets back to it.
+	expectStatuses(t, tracker.Advance(after(0)))
+	expectStatuses(t, tracker.Advance(after(299)))
+	updates := tracker.Advance(after(300))
+	expectStatuses(t, updates, messages.StatusExpired)
+	status := updates[0].Payload.(*messages.ClientRequestStatusUpdate)
+	if status.CreatedTime != toMillis(after(3600)) {
+		t.Errorf("request was created at %d, want %d", status.CreatedTime, toMillis(after(3600)))
+	}
+
+	// Small steps back, as when updates are slightly out of order, are not jumps.
+	tracker.Create(&messages.ClientRequestUpdate{ClientId: 1}, after(1000))
+	expectStatuses(t, tracker.Advance(after(990)))
+	expectStatuses(t, tracker.Advance(after(1600)), messages.StatusExpired)
+}
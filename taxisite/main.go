@@ -1,62 +1,117 @@
 package taxisite
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"taxistream/base"
+	"taxistream/messages"
 	"time"
 )
 
 var streamer *Streamer = nil
+var trackpointPrepper *TrackpointPrepper = nil
 var clientRequestStreamer *ClientRequestStreamer = nil
 
 type ClientRequestStreamer struct {
-	WebsocketChannel     map[*websocket.Conn]bool
+	Clients              *Hub
 	MaxClients           int
 	ClientRequestsPerSec float64
+	// Where and when clients request taxis. The rate above is the average, which follows the demand over the day.
+	Demand *demandModel
+	// Records all client requests, if configured.
+	Log *clientRequestLog
+	// The sequence number of the last message sent on the client request stream. Accessed atomically.
+	Seq int64
+	// Client requests are generated, submitted and advanced through their lifecycle concurrently, but one
+	// at a time, so that their messages are sent in order. Guards the tracker.
+	mutex   sync.Mutex
+	tracker *requestTracker
+	// Closed to stop generating client requests.
+	quit chan struct{}
 }
 
-// Exposes some endpoints to interact with the streaming application.
+// Exposes some endpoints to interact with the streaming application. Returns once the application
+// was shut down by an interrupt or termination signal.
 func ExposeEndpoints(conf base.Configuration) {
 	streamer = setUpStreamer(conf)
-	setUpTrackpointPrep(conf, *streamer)
+	trackpointPrepper = setUpTrackpointPrep(conf, streamer)
 
-	clientRequestStreamer = &ClientRequestStreamer{make(map[*websocket.Conn]bool, 0),
-		conf.MaxClients, conf.ClientRequestsPerSec}
+	demand, err := newDemandModel(conf)
+	if err != nil {
+		panic(err)
+	}
+	requestLog, err := newClientRequestLog(conf.ClientRequestLog)
+	if err != nil {
+		panic(err)
+	}
+	clientRequestStreamer = &ClientRequestStreamer{Clients: newHub("client request"), MaxClients: conf.MaxClients,
+		ClientRequestsPerSec: conf.ClientRequestsPerSec, Demand: demand, Log: requestLog,
+		tracker: newRequestTracker(conf.ClientPatience, conf.ClientCancelProbability, streamer.Matcher),
+		quit:    make(chan struct{})}
+	// Without a rate, clients only submit their own requests.
+	if conf.ClientRequestsPerSec > 0 {
+		go writeOccasionalClientRequest(clientRequestStreamer)
+	}
+	go trackClientRequests(clientRequestStreamer)
 
 	http.Handle("/", http.FileServer(http.Dir("./taxisite/static")))
 	http.HandleFunc("/ws", wsHandler)
 	http.HandleFunc("/ws-clients", wsHandlerClients)
+	http.HandleFunc("/client-requests", clientRequestsHandler)
+	http.Handle("/schema/", http.FileServer(http.FS(messages.Schemas)))
+	exposeControlEndpoints()
+	exposeMetricsEndpoints()
 
+	// Both servers run until shutdown, or until one of them fails.
+	serverErrors := make(chan error, 2)
+	var listener net.Listener = nil
 	if conf.TCPStream {
-		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(conf.TCPPort))
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(conf.TCPPort))
 		if err != nil {
 			fmt.Println("Error listening:", err.Error())
 			os.Exit(1)
 		}
-		// Close the listener when the application closes.
-		defer l.Close()
 		fmt.Println("Listening for TCP connections on 127.0.0.1:"+strconv.Itoa(conf.TCPPort))
-		for {
-			// Listen for an incoming connection.
-			conn, err := l.Accept()
-			if err != nil {
-				fmt.Println("Error accepting: ", err.Error())
-				os.Exit(1)
-			}
-			// Handle connections in a new goroutine.
-			go handleTCPRequest(conn)
-		}
+		go func() {
+			serverErrors <- acceptTCPConnections(listener)
+		}()
 	}
 
-	http.ListenAndServe(":"+strconv.Itoa(conf.WebSocketPort), nil)
+	server := &http.Server{Addr: ":" + strconv.Itoa(conf.WebSocketPort)}
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	waitForShutdown(serverErrors)
+	shutDown(server, listener)
+}
+
+// Accepts TCP connections until the listener is closed.
+func acceptTCPConnections(listener net.Listener) error {
+	for {
+		// Listen for an incoming connection.
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Handle connections in a new goroutine.
+		go handleTCPRequest(conn)
+	}
 }
 
 // Upgrades a connection to WebSockets.
@@ -66,111 +121,136 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Origin not allowed", 403)
 		return
 	}*/
+	serveWs(w, r, streamer.Clients, echo)
+}
+
+// Simply writes a message back to the sender (pong).
+func echo(p []byte) []byte {
+	return p
+}
+
+// Upgrades a connection to WebSockets and registers it as client of the given stream. Clients choose
+// the encoding and filter the messages they receive, e.g., /ws?encoding=protobuf&types=taxiLocation.
+// Messages the client sends are answered with the result of respond.
+func serveWs(w http.ResponseWriter, r *http.Request, hub *Hub, respond func([]byte) []byte) {
+	sub, err := streamer.newSubscription(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	conn, err := websocket.Upgrade(w, r, w.Header(), 1024, 1024)
 	if err != nil {
 		http.Error(w, "Could not open websocket connection", http.StatusBadRequest)
+		return
 	}
 
-	streamer.WebsocketChannel[conn] = true
-	log.Println("Serving", len(streamer.WebsocketChannel), "sockets.")
-	go handleWs(conn)
+	messageType := websocket.TextMessage
+	if sub.Encoder.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	client := newStreamClient("ws", conn.RemoteAddr().String(), sub, streamer.ClientQueueSize,
+		streamer.SlowConsumerPolicy, func(data []byte) error {
+			return conn.WriteMessage(messageType, data)
+		}, conn.Close, func(deadline time.Time) error {
+			// Tell the client why the connection is closed.
+			return conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), deadline)
+		})
+	if hub.Register(client) {
+		go handleWs(conn, client, hub, respond)
+	}
 }
 
-// Handles a websocket, in particular, closes it after the client goes offline.
-func handleWs(conn *websocket.Conn) {
-	defer conn.Close()
+// Handles a websocket, in particular, answers the messages of the client and closes it after the client goes offline.
+func handleWs(conn *websocket.Conn, client *streamClient, hub *Hub, respond func([]byte) []byte) {
+	defer hub.Unregister(client)
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsCloseError(err) || websocket.IsUnexpectedCloseError(err) {
-				delete(streamer.WebsocketChannel, conn)
-				log.Println("Serving", len(streamer.WebsocketChannel), "sockets.")
-			} else {
+			if !websocket.IsCloseError(err) && !websocket.IsUnexpectedCloseError(err) {
 				log.Println("Error when reading from WebSocket channel.")
-				delete(streamer.WebsocketChannel, conn)
-				log.Println("Serving", len(streamer.WebsocketChannel), "sockets.")
 			}
 			log.Println(err)
 			return
 		}
 
-		// Simply write the message back to the sender (pong).
-		if err := conn.WriteMessage(messageType, p); err != nil {
+		// Answer in between the streamed messages.
+		client.writeMutex.Lock()
+		err = conn.WriteMessage(messageType, respond(p))
+		client.writeMutex.Unlock()
+		if err != nil {
 			log.Println(err)
 			return
 		}
 	}
 }
 
-// Listens to TCP requests.
+// Listens to TCP requests. A client may subscribe by sending a handshake line with the same parameters
+// as WebSocket clients right after connecting, e.g., "encoding=protobuf&types=taxiLocation", which is answered
+// with "OK <encoding>". Clients that do not send one within a second get all messages as JSON.
 func handleTCPRequest(conn net.Conn) {
-	fmt.Println("Serving", len(streamer.TCPChannel), "TCP sockets.")
-	streamer.TCPChannel[&conn] = true
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	sub, err := tcpHandshake(conn, reader)
+	if err != nil {
+		fmt.Println("Error (TCP handshake):", err)
+		conn.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
+	}
+
+	client := newStreamClient("tcp", conn.RemoteAddr().String(), sub, streamer.ClientQueueSize,
+		streamer.SlowConsumerPolicy, func(data []byte) error {
+			_, err := conn.Write(tcpFrame(data, sub.Encoder))
+			return err
+		}, conn.Close, nil)
+	if !streamer.Clients.Register(client) {
+		return
+	}
+	defer streamer.Clients.Unregister(client)
 	// Make a buffer to hold incoming data.
 	buf := make([]byte, 1024)
-	// Read the incoming connection into the buffer.
-	defer conn.Close()
 	for {
-		_, err := conn.Read(buf)
+		_, err := reader.Read(buf)
 		if err != nil {
 			fmt.Println("Error reading:", err.Error())
-			streamer.TCPChannel[&conn] = false
 			break
 		}
-		// Send a response back to person contacting us.
+		// Send a response back to person contacting us, in between the streamed messages.
+		client.writeMutex.Lock()
 		conn.Write([]byte("Message received."))
+		client.writeMutex.Unlock()
 	}
 }
 
-// Upgrades a connection to WebSockets, in this case for clients.
-func wsHandlerClients(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Upgrade(w, r, w.Header(), 1024, 1024)
+// Waits shortly for the handshake of a TCP client and creates the requested subscription.
+func tcpHandshake(conn net.Conn, reader *bufio.Reader) (*subscription, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		// Nothing was sent, so the client just listens.
+		return streamer.newSubscription(url.Values{})
+	}
 	if err != nil {
-		http.Error(w, "Could not open websocket connection", http.StatusBadRequest)
+		return nil, errors.New("incomplete handshake")
 	}
-
-	// Here, we simply generate client requests occasionally.
-	clientRequestStreamer.WebsocketChannel[conn] = true
-	log.Println("Serving", len(clientRequestStreamer.WebsocketChannel), "client sockets.")
-	go handleWsClients(conn)
-	if len(clientRequestStreamer.WebsocketChannel) == 1 {
-		go writeOccasionalClientRequest(clientRequestStreamer)
-	} // Otherwise this already runs.
-}
-
-// Handles a websocket, in particular, closes it after the client goes offline.
-func handleWsClients(conn *websocket.Conn) {
-	defer conn.Close()
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			if websocket.IsCloseError(err) || websocket.IsUnexpectedCloseError(err) {
-				delete(clientRequestStreamer.WebsocketChannel, conn)
-				log.Println("Serving", len(clientRequestStreamer.WebsocketChannel), "client sockets.")
-			} else {
-				log.Println("Error when reading from WebSocket channel.")
-				delete(clientRequestStreamer.WebsocketChannel, conn)
-				log.Println("Serving", len(clientRequestStreamer.WebsocketChannel), "client sockets.")
-			}
-			log.Println(err)
-			return
-		}
-
-		// Simply write the message back to the sender (pong).
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.Println(err)
-			return
-		}
+	query, err := url.ParseQuery(strings.TrimSpace(line))
+	if err != nil {
+		return nil, err
 	}
+	sub, err := streamer.newSubscription(query)
+	if err != nil {
+		return nil, err
+	}
+	conn.Write([]byte("OK " + sub.Encoder.Format() + "\n"))
+	return sub, nil
 }
 
-type ClientRequestUpdate struct {
-	ClientId  int     `json:"clientId"`
-	OrigLon   float64 `json:"origLon"`
-	OrigLat   float64 `json:"origLat"`
-	DestLon   float64 `json:"destLon"`
-	DestLat   float64 `json:"destLat"`
-	WillShare bool    `json:"willShare"`
+// Upgrades a connection to WebSockets, in this case for clients.
+func wsHandlerClients(w http.ResponseWriter, r *http.Request) {
+	// Client requests are generated occasionally (see writeOccasionalClientRequest), and clients may submit
+	// their own ride requests.
+	serveWs(w, r, clientRequestStreamer.Clients, handleRideRequestMessage)
 }
 
 // Random boolean generator.
@@ -188,18 +268,41 @@ func randlon() float64 {
 	return -74.02 + rand.Float64()*0.26
 }
 
-// Occasionally writes a client request on the WebSocket.
+// Occasionally writes a client request to the clients of the client request stream, as long as there are any.
+// Requests follow the demand at the current time of the replay, and stop while the replay is paused.
 func writeOccasionalClientRequest(clientRequestStreamer *ClientRequestStreamer) {
 	for {
-		if len(clientRequestStreamer.WebsocketChannel) > 0 {
-			msg, _ := json.Marshal(ClientRequestUpdate{rand.Intn(clientRequestStreamer.MaxClients),
-				randlon(), randlat(), randlon(), randlat(), randbool()})
-			for c := range clientRequestStreamer.WebsocketChannel {
-				c.WriteMessage(websocket.TextMessage, msg)
-			}
-		} else {
+		// Client requests are not part of the replayed data, so they happen at the current time of the taxi stream.
+		eventTime := replayClock()
+		factor := clientRequestStreamer.Demand.Factor(eventTime)
+		if clientRequestStreamer.Clients.Len() > 0 && !streamer.IsPaused() && factor > 0 {
+			trip := clientRequestStreamer.Demand.Sample(eventTime)
+			clientRequestStreamer.publish(&messages.ClientRequestUpdate{
+				ClientId: -1, OrigLon: trip.OrigLon, OrigLat: trip.OrigLat,
+				DestLon: trip.DestLon, DestLat: trip.DestLat, WillShare: randbool()}, eventTime, sourceGenerated)
+		}
+		wait := demandIdleInterval
+		if factor > 0 {
+			wait = time.Duration(1000000000.0/(clientRequestStreamer.ClientRequestsPerSec*factor)) * time.Nanosecond
+		}
+		select {
+		case <-time.After(wait):
+		case <-clientRequestStreamer.quit:
+			return
+		}
+	}
+}
+
+// Advances the client requests through their lifecycle as the replay goes on, until client requests stop.
+func trackClientRequests(clientRequestStreamer *ClientRequestStreamer) {
+	ticker := time.NewTicker(requestTrackingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			clientRequestStreamer.advance(replayClock())
+		case <-clientRequestStreamer.quit:
 			return
 		}
-		time.Sleep(time.Duration(1000000000.0/clientRequestStreamer.ClientRequestsPerSec) * time.Nanosecond)
 	}
 }
@@ -0,0 +1,187 @@
+package taxisite
+
+import (
+	"math"
+	"sync"
+	"taxistream/base"
+	"taxistream/messages"
+	"taxistream/taxisim"
+	"time"
+)
+
+// How long a taxi may take to reach a client at most if not configured, in simulated seconds.
+const defaultMatcherMaxEta = 600.0
+
+// How much longer the way to a client is than the straight line, as taxis have to follow the roads.
+const matcherDetourFactor = 1.3
+
+// A simple matcher that assigns every client request to the closest free taxi of the taxi stream, as a baseline
+// for matchers built on the streams. The assigned taxi does not actually drive to the client, as the taxis follow
+// the recorded trips, but it is not assigned again until it would have arrived.
+type Matcher struct {
+	// Requests that no free taxi can reach within this many simulated seconds are rejected.
+	MaxEta float64
+	Speeds *taxisim.SpeedModel
+
+	// Guards the taxis and the metrics, as the taxi stream updates the taxis while client requests are matched.
+	mutex sync.Mutex
+	taxis map[int32]*matcherTaxi
+	// The taxi assigned to each request, until the request is released.
+	assignments map[int64]int32
+
+	requests  int64
+	matched   int64
+	rejected  int64
+	totalWait float64
+	maxWait   float64
+}
+
+// What the matcher knows about a taxi from the taxi stream.
+type matcherTaxi struct {
+	Lon  float64
+	Lat  float64
+	Free bool
+	// The simulated time until which the taxi is on its way to a client it was assigned to, and the request.
+	AssignedUntil time.Time
+	RequestId     int64
+}
+
+// The metrics of the matcher, as reported by /metrics/matcher. Wait times are the ETAs of the assigned taxis,
+// in simulated seconds.
+type MatcherStats struct {
+	Requests  int64   `json:"requests"`
+	Matched   int64   `json:"matched"`
+	Rejected  int64   `json:"rejected"`
+	MatchRate float64 `json:"matchRate"`
+	MeanWait  float64 `json:"meanWait"`
+	MaxWait   float64 `json:"maxWait"`
+	FreeTaxis int     `json:"freeTaxis"`
+}
+
+// Creates the matcher, or returns nil if it is not enabled.
+func newMatcher(conf base.Configuration) (*Matcher, error) {
+	if !conf.Matcher {
+		return nil, nil
+	}
+	speeds, err := taxisim.NewSpeedModel(conf)
+	if err != nil {
+		return nil, err
+	}
+	maxEta := conf.MatcherMaxEta
+	if maxEta <= 0 {
+		maxEta = defaultMatcherMaxEta
+	}
+	return &Matcher{MaxEta: maxEta, Speeds: speeds, taxis: make(map[int32]*matcherTaxi),
+		assignments: make(map[int64]int32)}, nil
+}
+
+// Updates the state of the taxis with a message of the taxi stream. Taxis are free while they carry no passengers
+// and are not reserved.
+func (matcher *Matcher) Observe(u *messages.Envelope) {
+	matcher.mutex.Lock()
+	defer matcher.mutex.Unlock()
+	switch p := u.Payload.(type) {
+	case *messages.TaxiUpdate:
+		taxi := matcher.taxi(p.TaxiId)
+		taxi.Lon, taxi.Lat = p.Lon, p.Lat
+		taxi.Free = p.NumOccupants == 0 && p.ReservationLon == nil
+	case *messages.TaxiOccupancyUpdate:
+		matcher.taxi(p.TaxiId).Free = p.NumOccupants == 0
+	case *messages.TaxiReservationUpdate:
+		matcher.taxi(p.TaxiId).Free = false
+	case *messages.PickupStartedUpdate:
+		matcher.taxi(p.TaxiId).Free = false
+	}
+}
+
+// Gets a taxi, which is added if it is not known yet.
+func (matcher *Matcher) taxi(taxiId int32) *matcherTaxi {
+	taxi, ok := matcher.taxis[taxiId]
+	if !ok {
+		taxi = &matcherTaxi{}
+		matcher.taxis[taxiId] = taxi
+	}
+	return taxi
+}
+
+// Assigns a client request made at time t to the free taxi that reaches it first. Returns the assignment,
+// or the rejection if no free taxi reaches the client in time.
+func (matcher *Matcher) Match(r *messages.ClientRequestUpdate, t time.Time) *messages.Envelope {
+	matcher.mutex.Lock()
+	defer matcher.mutex.Unlock()
+	matcher.requests += 1
+
+	var closest *matcherTaxi = nil
+	closestId := int32(0)
+	closestDistance := math.Inf(1)
+	for taxiId, taxi := range matcher.taxis {
+		if !taxi.Free || taxi.AssignedUntil.After(t) {
+			continue
+		}
+		distance := taxisim.Distance(taxi.Lon, taxi.Lat, r.OrigLon, r.OrigLat) * matcherDetourFactor
+		if distance < closestDistance || (distance == closestDistance && taxiId < closestId) {
+			closest, closestId, closestDistance = taxi, taxiId, distance
+		}
+	}
+	if closest == nil {
+		matcher.rejected += 1
+		return messages.NewEnvelope(&messages.RequestRejectedUpdate{RequestId: r.RequestId, ClientId: r.ClientId,
+			Reason: "no free taxi"}, t)
+	}
+	eta := matcher.Speeds.TravelTime(t, closestDistance, 0).Seconds()
+	if eta > matcher.MaxEta {
+		matcher.rejected += 1
+		return messages.NewEnvelope(&messages.RequestRejectedUpdate{RequestId: r.RequestId, ClientId: r.ClientId,
+			Reason: "no free taxi close enough"}, t)
+	}
+	if r.MaxWait > 0 && eta > r.MaxWait {
+		matcher.rejected += 1
+		return messages.NewEnvelope(&messages.RequestRejectedUpdate{RequestId: r.RequestId, ClientId: r.ClientId,
+			Reason: "no free taxi within the maximum wait"}, t)
+	}
+
+	closest.AssignedUntil = t.Add(time.Duration(eta * float64(time.Second)))
+	closest.RequestId = r.RequestId
+	matcher.assignments[r.RequestId] = closestId
+	matcher.matched += 1
+	matcher.totalWait += eta
+	matcher.maxWait = math.Max(matcher.maxWait, eta)
+	return messages.NewEnvelope(&messages.RequestAssignedUpdate{RequestId: r.RequestId, ClientId: r.ClientId,
+		TaxiId: closestId, TaxiLon: closest.Lon, TaxiLat: closest.Lat, Distance: closestDistance, Eta: eta}, t)
+}
+
+// Frees the taxi assigned to a request that ended, e.g., because the client cancelled it, so that the taxi can be
+// assigned again right away. Requests without a taxi (or whose taxi is already assigned again) are ignored.
+func (matcher *Matcher) Release(requestId int64) {
+	matcher.mutex.Lock()
+	defer matcher.mutex.Unlock()
+	taxiId, ok := matcher.assignments[requestId]
+	if !ok {
+		return
+	}
+	delete(matcher.assignments, requestId)
+	if taxi := matcher.taxis[taxiId]; taxi.RequestId == requestId {
+		taxi.AssignedUntil = time.Time{}
+	}
+}
+
+// Reports how many requests were matched, how long clients wait for their taxi, and how many taxis are free
+// at time t.
+func (matcher *Matcher) Stats(t time.Time) MatcherStats {
+	matcher.mutex.Lock()
+	defer matcher.mutex.Unlock()
+	stats := MatcherStats{Requests: matcher.requests, Matched: matcher.matched, Rejected: matcher.rejected,
+		MaxWait: matcher.maxWait}
+	if matcher.requests > 0 {
+		stats.MatchRate = float64(matcher.matched) / float64(matcher.requests)
+	}
+	if matcher.matched > 0 {
+		stats.MeanWait = matcher.totalWait / float64(matcher.matched)
+	}
+	for _, taxi := range matcher.taxis {
+		if taxi.Free && !taxi.AssignedUntil.After(t) {
+			stats.FreeTaxis += 1
+		}
+	}
+	return stats
+}
@@ -0,0 +1,70 @@
+package taxisite
+
+import (
+	"testing"
+	"time"
+
+	"taxistream/base"
+	"taxistream/messages"
+)
+
+func newTestMatcher(t *testing.T) *Matcher {
+	matcher, err := newMatcher(base.Configuration{Matcher: true, MatcherMaxEta: 1e6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matcher
+}
+
+func TestMatcherAssignsClosestFreeTaxi(t *testing.T) {
+	matcher := newTestMatcher(t)
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	matcher.Observe(messages.NewEnvelope(&messages.TaxiUpdate{TaxiId: 1, Lon: -73.98, Lat: 40.75}, now))
+	matcher.Observe(messages.NewEnvelope(&messages.TaxiUpdate{TaxiId: 2, Lon: -73.90, Lat: 40.70}, now))
+	matcher.Observe(messages.NewEnvelope(&messages.TaxiUpdate{TaxiId: 3, Lon: -73.981, Lat: 40.751,
+		NumOccupants: 1}, now))
+
+	outcome := matcher.Match(&messages.ClientRequestUpdate{RequestId: 7, OrigLon: -73.981, OrigLat: 40.751}, now)
+	assigned, ok := outcome.Payload.(*messages.RequestAssignedUpdate)
+	if !ok || assigned.TaxiId != 1 || assigned.RequestId != 7 {
+		t.Fatalf("request was answered with %+v, want taxi 1", outcome.Payload)
+	}
+	outcome = matcher.Match(&messages.ClientRequestUpdate{RequestId: 8, OrigLon: -73.981, OrigLat: 40.751}, now)
+	if assigned, ok := outcome.Payload.(*messages.RequestAssignedUpdate); !ok || assigned.TaxiId != 2 {
+		t.Fatalf("second request was answered with %+v, want taxi 2", outcome.Payload)
+	}
+	outcome = matcher.Match(&messages.ClientRequestUpdate{RequestId: 9, OrigLon: -73.981, OrigLat: 40.751}, now)
+	if rejected, ok := outcome.Payload.(*messages.RequestRejectedUpdate); !ok || rejected.RequestId != 9 {
+		t.Fatalf("third request was answered with %+v, want a rejection", outcome.Payload)
+	}
+}
+
+func TestMatcherReleaseFreesTaxi(t *testing.T) {
+	matcher := newTestMatcher(t)
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	matcher.Observe(messages.NewEnvelope(&messages.TaxiUpdate{TaxiId: 1, Lon: -73.98, Lat: 40.75}, now))
+	request := &messages.ClientRequestUpdate{RequestId: 1, OrigLon: -73.95, OrigLat: 40.78}
+	if _, ok := matcher.Match(request, now).Payload.(*messages.RequestAssignedUpdate); !ok {
+		t.Fatalf("request was not assigned")
+	}
+	if stats := matcher.Stats(now); stats.FreeTaxis != 0 {
+		t.Errorf("%d taxis are free while the only one is assigned", stats.FreeTaxis)
+	}
+
+	// Releasing an unknown request (or one released before) has no effect.
+	matcher.Release(5)
+	matcher.Release(1)
+	matcher.Release(1)
+	if stats := matcher.Stats(now); stats.FreeTaxis != 1 {
+		t.Errorf("%d taxis are free after the request was released, want 1", stats.FreeTaxis)
+	}
+	request = &messages.ClientRequestUpdate{RequestId: 2, OrigLon: -73.95, OrigLat: 40.78}
+	if _, ok := matcher.Match(request, now).Payload.(*messages.RequestAssignedUpdate); !ok {
+		t.Fatalf("released taxi was not assigned again")
+	}
+	// A released request must not free the taxi while it is on its way to another client.
+	matcher.Release(1)
+	if stats := matcher.Stats(now); stats.FreeTaxis != 0 {
+		t.Errorf("releasing an old request freed the taxi of a new one")
+	}
+}
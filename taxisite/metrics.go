@@ -0,0 +1,70 @@
+package taxisite
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The flow-control metrics of the taxi stream, as reported by /metrics/stream.
+type StreamStats struct {
+	Queued         int     `json:"queued"`
+	QueueSize      int     `json:"queueSize"`
+	Sent           int64   `json:"sent"`
+	SendRate       float64 `json:"sendRate"`
+	GenerationRate float64 `json:"generationRate"`
+	Shed           int64   `json:"shed"`
+	BlockedMs      int64   `json:"blockedMs"`
+}
+
+// Registers the endpoints that report metrics of the running stream.
+func exposeMetricsEndpoints() {
+	http.HandleFunc("/metrics/stream", metricsStreamHandler)
+	http.HandleFunc("/metrics/clients", metricsClientsHandler)
+	http.HandleFunc("/metrics/matcher", metricsMatcherHandler)
+}
+
+// Reports how full the update queue is, how fast updates are generated and sent, and how many were shed
+// or how long the trackpoint preparation was blocked because the streamer could not keep up.
+func metricsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	trackpointPrepper.mutex.Lock()
+	sendRate, generationRate := trackpointPrepper.SendRate, trackpointPrepper.GenerationRate
+	trackpointPrepper.mutex.Unlock()
+	stats := StreamStats{len(*streamer.TaxiupdateChannel), cap(*streamer.TaxiupdateChannel),
+		atomic.LoadInt64(&streamer.Seq), sendRate, generationRate,
+		atomic.LoadInt64(&trackpointPrepper.shed),
+		atomic.LoadInt64(&trackpointPrepper.blockedNanos) / int64(time.Millisecond)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Reports the queue and lag metrics of all clients of the taxi and client request streams.
+func metricsClientsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := make([]ClientStats, 0)
+	for _, hub := range []*Hub{streamer.Clients, clientRequestStreamer.Clients} {
+		hub.Broadcast(func(client *streamClient) {
+			clientStats := client.Stats()
+			clientStats.Stream = hub.Name
+			stats = append(stats, clientStats)
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Id < stats[j].Id })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Reports how many client requests the matcher assigned, and how long the clients wait for their taxis.
+func metricsMatcherHandler(w http.ResponseWriter, r *http.Request) {
+	if streamer.Matcher == nil {
+		http.Error(w, "The matcher is not enabled", http.StatusNotFound)
+		return
+	}
+	stats := streamer.Matcher.Stats(replayClock())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,161 @@
+package taxisite
+
+import (
+	"encoding/csv"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"taxistream/base"
+	"taxistream/messages"
+	"time"
+)
+
+// How many later messages overtake a delayed fix at most, if not configured.
+const defaultReorderDelay = 10
+
+// The metres per degree of latitude.
+const metresPerDegree = 111320.0
+
+// Adds the errors of real GPS receivers to the location updates of a window: noisy and sometimes far off positions,
+// lost, duplicated and late fixes, and irregular reporting times. Only the trackpoint preparation uses it, so it
+// is not safe for concurrent use.
+type gpsNoise struct {
+	conf base.NoiseConfiguration
+	rand *rand.Rand
+
+	truthFile *os.File
+	truth     *csv.Writer
+}
+
+// A fix that is held back until some later messages were sent.
+type delayedFix struct {
+	Update *messages.Envelope
+	After  int
+}
+
+// Creates the noise model, or returns nil if no error is configured.
+func newGPSNoise(conf base.NoiseConfiguration) (*gpsNoise, error) {
+	if conf.PositionError <= 0 && conf.MultipathProbability <= 0 && conf.DropProbability <= 0 &&
+		conf.DuplicateProbability <= 0 && conf.ReorderProbability <= 0 && conf.TimeJitter <= 0 &&
+		conf.GroundTruthFile == "" {
+		return nil, nil
+	}
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if conf.ReorderDelay <= 0 {
+		conf.ReorderDelay = defaultReorderDelay
+	}
+	noise := &gpsNoise{conf: conf, rand: rand.New(rand.NewSource(seed))}
+	if conf.GroundTruthFile != "" {
+		file, err := os.Create(conf.GroundTruthFile)
+		if err != nil {
+			return nil, err
+		}
+		noise.truthFile = file
+		noise.truth = csv.NewWriter(file)
+		noise.truth.Write([]string{"taxiId", "eventTime", "lon", "lat", "noisyLon", "noisyLat", "fate"})
+	}
+	return noise, nil
+}
+
+// Shifts the time a fix is taken at randomly.
+func (noise *gpsNoise) Jitter(t time.Time) time.Time {
+	if noise.conf.TimeJitter <= 0 {
+		return t
+	}
+	return t.Add(time.Duration((noise.rand.Float64()*2 - 1) * noise.conf.TimeJitter * float64(time.Second)))
+}
+
+// Adds errors to the location updates, leaving all other updates as they are.
+func (noise *gpsNoise) Apply(updates []*messages.Envelope) []*messages.Envelope {
+	noisy := make([]*messages.Envelope, 0, len(updates))
+	delayed := make([]*delayedFix, 0)
+	// Appends an update, and with it, the delayed fixes that were overtaken by enough messages.
+	emit := func(u *messages.Envelope) {
+		noisy = append(noisy, u)
+		due := delayed[:0]
+		for _, d := range delayed {
+			d.After -= 1
+			if d.After > 0 {
+				due = append(due, d)
+			} else {
+				noisy = append(noisy, d.Update)
+			}
+		}
+		delayed = due
+	}
+
+	for _, u := range updates {
+		p, ok := u.Payload.(*messages.TaxiUpdate)
+		if !ok {
+			emit(u)
+			continue
+		}
+		if noise.rand.Float64() < noise.conf.DropProbability {
+			noise.record(p, nil, u.Ts.EventTime, "dropped")
+			continue
+		}
+
+		fate := "sent"
+		q := *p
+		metresEast := noise.rand.NormFloat64() * noise.conf.PositionError
+		metresNorth := noise.rand.NormFloat64() * noise.conf.PositionError
+		if noise.rand.Float64() < noise.conf.MultipathProbability {
+			distance := noise.rand.ExpFloat64() * noise.conf.MultipathError
+			direction := noise.rand.Float64() * 2 * math.Pi
+			metresEast += distance * math.Sin(direction)
+			metresNorth += distance * math.Cos(direction)
+			fate = "multipath"
+		}
+		q.Lat += metresNorth / metresPerDegree
+		q.Lon += metresEast / (metresPerDegree * math.Cos(p.Lat*math.Pi/180))
+		e := *u
+		e.Payload = &q
+
+		switch {
+		case noise.rand.Float64() < noise.conf.DuplicateProbability:
+			emit(&e)
+			d := e
+			emit(&d)
+			fate = "duplicated"
+		case noise.rand.Float64() < noise.conf.ReorderProbability:
+			delayed = append(delayed, &delayedFix{&e, 1 + noise.rand.Intn(noise.conf.ReorderDelay)})
+			fate = "delayed"
+		default:
+			emit(&e)
+		}
+		noise.record(p, &q, u.Ts.EventTime, fate)
+	}
+	for _, d := range delayed {
+		noisy = append(noisy, d.Update)
+	}
+	if noise.truth != nil {
+		noise.truth.Flush()
+	}
+	return noisy
+}
+
+// Writes the true and the noisy position of a fix to the ground truth file, if there is one.
+func (noise *gpsNoise) record(truth *messages.TaxiUpdate, noisy *messages.TaxiUpdate, eventTime int64, fate string) {
+	if noise.truth == nil {
+		return
+	}
+	noisyLon, noisyLat := "", ""
+	if noisy != nil {
+		noisyLon = strconv.FormatFloat(noisy.Lon, 'f', 7, 64)
+		noisyLat = strconv.FormatFloat(noisy.Lat, 'f', 7, 64)
+	}
+	noise.truth.Write([]string{strconv.Itoa(int(truth.TaxiId)), strconv.FormatInt(eventTime, 10),
+		strconv.FormatFloat(truth.Lon, 'f', 7, 64), strconv.FormatFloat(truth.Lat, 'f', 7, 64), noisyLon, noisyLat, fate})
+}
+
+// Closes the ground truth file.
+func (noise *gpsNoise) Close() {
+	if noise.truthFile != nil {
+		noise.truth.Flush()
+		noise.truthFile.Close()
+	}
+}
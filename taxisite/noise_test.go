@@ -0,0 +1,158 @@
+package taxisite
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"taxistream/base"
+	"taxistream/messages"
+)
+
+// A window of location updates of the given number of taxis, each followed by an occupancy update.
+func noiseWindow(taxis int) []*messages.Envelope {
+	now := time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)
+	updates := make([]*messages.Envelope, 0, 2*taxis)
+	for i := 0; i < taxis; i++ {
+		updates = append(updates,
+			messages.NewEnvelope(&messages.TaxiUpdate{TaxiId: int32(i), Lon: -73.98, Lat: 40.75}, now),
+			messages.NewEnvelope(&messages.TaxiOccupancyUpdate{TaxiId: int32(i)}, now))
+	}
+	return updates
+}
+
+func newTestNoise(t *testing.T, conf base.NoiseConfiguration) *gpsNoise {
+	noise, err := newGPSNoise(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return noise
+}
+
+func TestNoiseIsOffByDefault(t *testing.T) {
+	if noise := newTestNoise(t, base.NoiseConfiguration{Seed: 1}); noise != nil {
+		t.Errorf("noise model was created without any errors configured")
+	}
+}
+
+func TestNoiseIsRepeatableWithSeed(t *testing.T) {
+	conf := base.NoiseConfiguration{Seed: 42, PositionError: 5, DropProbability: 0.1, ReorderProbability: 0.1}
+	first := newTestNoise(t, conf).Apply(noiseWindow(100))
+	second := newTestNoise(t, conf).Apply(noiseWindow(100))
+	if len(first) != len(second) {
+		t.Fatalf("same seed gave %d and %d updates", len(first), len(second))
+	}
+	for i := range first {
+		if first[i].Type != second[i].Type {
+			t.Fatalf("same seed gave %s and %s at %d", first[i].Type, second[i].Type, i)
+		}
+		if p, ok := first[i].Payload.(*messages.TaxiUpdate); ok && *p != *second[i].Payload.(*messages.TaxiUpdate) {
+			t.Fatalf("same seed gave positions %+v and %+v", p, second[i].Payload)
+		}
+	}
+}
+
+func TestPositionErrorHasConfiguredStdDev(t *testing.T) {
+	window := noiseWindow(2000)
+	noisy := newTestNoise(t, base.NoiseConfiguration{Seed: 1, PositionError: 10}).Apply(window)
+	if len(noisy) != len(window) {
+		t.Fatalf("%d of %d updates were sent", len(noisy), len(window))
+	}
+	squares := 0.0
+	for i, u := range noisy {
+		if u.Type != window[i].Type {
+			t.Fatalf("update %d is %s, want %s", i, u.Type, window[i].Type)
+		}
+		p, ok := u.Payload.(*messages.TaxiUpdate)
+		if !ok {
+			continue
+		}
+		metresNorth := (p.Lat - 40.75) * metresPerDegree
+		metresEast := (p.Lon + 73.98) * metresPerDegree * math.Cos(40.75*math.Pi/180)
+		squares += metresNorth*metresNorth + metresEast*metresEast
+	}
+	// Both components have the standard deviation, so the mean square distance is twice its square.
+	if stdDev := math.Sqrt(squares / 2000 / 2); stdDev < 9 || stdDev > 11 {
+		t.Errorf("positions are off by %.2f m (standard deviation), want 10 m", stdDev)
+	}
+	// The original updates are left as they are.
+	if p := window[0].Payload.(*messages.TaxiUpdate); p.Lon != -73.98 || p.Lat != 40.75 {
+		t.Errorf("original update was changed to %+v", p)
+	}
+}
+
+func TestNoiseFates(t *testing.T) {
+	tests := []struct {
+		conf      base.NoiseConfiguration
+		locations int
+	}{
+		{base.NoiseConfiguration{Seed: 1, DropProbability: 1}, 0},
+		{base.NoiseConfiguration{Seed: 1, DuplicateProbability: 1}, 200},
+		{base.NoiseConfiguration{Seed: 1, ReorderProbability: 1, ReorderDelay: 3}, 100},
+	}
+	for _, test := range tests {
+		noisy := newTestNoise(t, test.conf).Apply(noiseWindow(100))
+		locations, occupancies := 0, 0
+		for _, u := range noisy {
+			if u.Type == messages.TypeTaxiLocation {
+				locations += 1
+			} else {
+				occupancies += 1
+			}
+		}
+		if locations != test.locations || occupancies != 100 {
+			t.Errorf("%+v sent %d locations and %d other updates, want %d and 100", test.conf, locations,
+				occupancies, test.locations)
+		}
+	}
+
+	// Delayed fixes are overtaken by at least one and at most ReorderDelay messages, here, the occupancy updates of
+	// the same and the next two taxis.
+	noisy := newTestNoise(t, base.NoiseConfiguration{Seed: 1, ReorderProbability: 1, ReorderDelay: 3}).
+		Apply(noiseWindow(100))
+	occupancies := make(map[int32]int)
+	for i, u := range noisy {
+		if o, ok := u.Payload.(*messages.TaxiOccupancyUpdate); ok {
+			occupancies[o.TaxiId] = i
+		}
+	}
+	for i, u := range noisy {
+		p, ok := u.Payload.(*messages.TaxiUpdate)
+		if !ok {
+			continue
+		}
+		if i < occupancies[p.TaxiId] || (p.TaxiId+3 < 100 && i > occupancies[p.TaxiId+3]) {
+			t.Errorf("fix of taxi %d is sent at %d, want between %d and %d", p.TaxiId, i,
+				occupancies[p.TaxiId], occupancies[p.TaxiId+3])
+		}
+	}
+}
+
+func TestGroundTruthFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "truth.csv")
+	noise := newTestNoise(t, base.NoiseConfiguration{Seed: 1, PositionError: 5, DropProbability: 0.5,
+		GroundTruthFile: filename})
+	noise.Apply(noiseWindow(50))
+	noise.Close()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 51 || records[0][0] != "taxiId" {
+		t.Fatalf("ground truth has %d records, want a header and 50 fixes", len(records))
+	}
+	for _, record := range records[1:] {
+		if (record[6] == "dropped") != (record[4] == "") {
+			t.Errorf("fix %v has a noisy position exactly if it was not dropped", record)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package taxisite
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// How messages are spread over time: {'constant', 'poisson', 'realtime'}. Constant sends them evenly spaced
+// at the target speed, Poisson with exponentially distributed gaps (averaging the target speed), and realtime
+// at their event time, scaled by the time warp (ignoring the target speed).
+const (
+	pacingConstant = "constant"
+	pacingPoisson  = "poisson"
+	pacingRealtime = "realtime"
+)
+
+// How far a realtime replay may fall behind before it gives up catching up.
+const maxRealtimeLag = time.Second
+
+// How far back in simulated time a message may go before a realtime replay starts over (e.g., when the replay
+// loops). Messages that are less out of order are sent right away.
+const maxRealtimeReorder = time.Minute
+
+// How late the pacer may wake up from sleeping (or get to run at all). This is made up for by the following
+// messages even if the burst is 1, as otherwise the throughput would depend on the timer and the scheduler.
+const timerSlack = 10 * time.Millisecond
+
+// Paces the messages of the stream. This is a token bucket in virtual scheduling form: every message is
+// scheduled a fixed (or for Poisson, random) interval after the previous one. If messages arrive late, up to
+// Burst of them are sent back to back to catch up, but no more.
+type Pacer struct {
+	Burst   float64
+	Profile string
+
+	// When the next message is due, and for realtime pacing, which event time corresponds to which wall-clock time.
+	next        time.Time
+	anchorWall  time.Time
+	anchorEvent int64
+	// The latest event time (in ms) seen so far.
+	lastEvent int64
+
+	// The rate (in messages per second) and the time warp for realtime pacing, as float64 bits, and whether
+	// the schedule has to start over. They are set by other goroutines, so they are accessed atomically.
+	rate     uint64
+	timeWarp uint64
+	reset    int32
+
+	// The clock the pacer runs on, and how it sleeps until a message is due (or quit is closed).
+	now   func() time.Time
+	sleep func(d time.Duration, quit <-chan struct{})
+}
+
+func newPacer(rate float64, burst float64, profile string, timeWarp float64) *Pacer {
+	if burst < 1 {
+		burst = 1
+	}
+	pacer := &Pacer{Burst: burst, Profile: profile, now: time.Now, sleep: sleep}
+	pacer.SetRate(rate)
+	pacer.SetTimeWarp(timeWarp)
+	pacer.Reset()
+	return pacer
+}
+
+// Changes the rate for constant and Poisson pacing.
+func (pacer *Pacer) SetRate(rate float64) {
+	atomic.StoreUint64(&pacer.rate, math.Float64bits(rate))
+	pacer.Reset()
+}
+
+// The rate for constant and Poisson pacing, in messages per second.
+func (pacer *Pacer) Rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&pacer.rate))
+}
+
+// Changes the time warp used for realtime pacing.
+func (pacer *Pacer) SetTimeWarp(timeWarp float64) {
+	atomic.StoreUint64(&pacer.timeWarp, math.Float64bits(timeWarp))
+	pacer.Reset()
+}
+
+// Sleeps for the given duration, or until quit is closed.
+func sleep(d time.Duration, quit <-chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-quit:
+	}
+}
+
+// Starts the schedule over with the next message, e.g., after a pause or seek. No burst is sent to catch up.
+func (pacer *Pacer) Reset() {
+	atomic.StoreInt32(&pacer.reset, 1)
+}
+
+// Waits until the message with the given event time (in ms) is due, or until quit is closed.
+// Returns how long it waited.
+func (pacer *Pacer) Wait(eventTime int64, quit <-chan struct{}) time.Duration {
+	now := pacer.now()
+	reset := atomic.CompareAndSwapInt32(&pacer.reset, 1, 0)
+
+	var due time.Time
+	if pacer.Profile == pacingRealtime {
+		timeWarp := math.Float64frombits(atomic.LoadUint64(&pacer.timeWarp))
+		due = pacer.anchorWall.Add(time.Duration(float64(eventTime-pacer.anchorEvent) * float64(time.Millisecond) / timeWarp))
+		backwards := eventTime < pacer.lastEvent-int64(maxRealtimeReorder/time.Millisecond)
+		behind := eventTime >= pacer.lastEvent && due.Before(now.Add(-maxRealtimeLag))
+		if reset || backwards || behind {
+			pacer.anchorWall, pacer.anchorEvent, pacer.lastEvent = now, eventTime, eventTime
+			due = now
+		}
+		if eventTime > pacer.lastEvent {
+			pacer.lastEvent = eventTime
+		}
+	} else {
+		// Messages that are late may catch up by at most a burst.
+		rate := pacer.Rate()
+		earliest := now.Add(-time.Duration((pacer.Burst-1)/rate*float64(time.Second)) - timerSlack)
+		if reset {
+			pacer.next = now
+		} else if pacer.next.Before(earliest) {
+			pacer.next = earliest
+		}
+		due = pacer.next
+		interval := 1.0 / rate
+		if pacer.Profile == pacingPoisson {
+			interval *= rand.ExpFloat64()
+		}
+		pacer.next = pacer.next.Add(time.Duration(interval * float64(time.Second)))
+	}
+
+	wait := due.Sub(now)
+	if wait <= 0 {
+		return 0
+	}
+	pacer.sleep(wait, quit)
+	return pacer.now().Sub(now)
+}
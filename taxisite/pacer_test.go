@@ -0,0 +1,147 @@
+package taxisite
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when the pacer sleeps, or when a test lets time pass.
+type fakeClock struct {
+	t time.Time
+}
+
+func (clock *fakeClock) now() time.Time {
+	return clock.t
+}
+
+func (clock *fakeClock) sleep(d time.Duration, quit <-chan struct{}) {
+	clock.t = clock.t.Add(d)
+}
+
+func newTestPacer(rate float64, burst float64, profile string, timeWarp float64) (*Pacer, *fakeClock) {
+	clock := &fakeClock{time.Date(2016, 1, 1, 8, 0, 0, 0, time.UTC)}
+	pacer := newPacer(rate, burst, profile, timeWarp)
+	pacer.now, pacer.sleep = clock.now, clock.sleep
+	return pacer, clock
+}
+
+// Sends n messages through the pacer as fast as it lets them through. Returns the achieved rate.
+func measureRate(pacer *Pacer, clock *fakeClock, n int) float64 {
+	quit := make(chan struct{})
+	start := clock.now()
+	for i := 0; i < n; i++ {
+		pacer.Wait(0, quit)
+	}
+	// The first message is sent right away, so n messages take n-1 intervals.
+	return float64(n-1) / clock.now().Sub(start).Seconds()
+}
+
+func TestPacerAchievesTargetRate(t *testing.T) {
+	pacer, clock := newTestPacer(1000, 1, pacingConstant, 1)
+	if rate := measureRate(pacer, clock, 400); math.Abs(rate-1000) > 1e-6 {
+		t.Errorf("constant pacing achieved %.3f messages/s, want 1000", rate)
+	}
+	// The mean of 4000 exponential gaps is within 10% with overwhelming probability.
+	pacer, clock = newTestPacer(1000, 1, pacingPoisson, 1)
+	if rate := measureRate(pacer, clock, 4000); math.Abs(rate-1000)/1000 > 0.1 {
+		t.Errorf("Poisson pacing achieved %.0f messages/s, want 1000 within 10%%", rate)
+	}
+}
+
+func TestPacerSetRate(t *testing.T) {
+	pacer, clock := newTestPacer(100, 1, pacingConstant, 1)
+	pacer.SetRate(2000)
+	if rate := measureRate(pacer, clock, 400); math.Abs(rate-2000) > 1e-6 {
+		t.Errorf("pacing achieved %.3f messages/s after changing the rate, want 2000", rate)
+	}
+}
+
+// Lets the pacer fall behind by the time of 30 messages, after sending one message.
+func stalledPacer(profile string, burst float64) (*Pacer, *fakeClock) {
+	pacer, clock := newTestPacer(100, burst, profile, 1)
+	pacer.Wait(0, make(chan struct{}))
+	clock.t = clock.t.Add(300 * time.Millisecond)
+	return pacer, clock
+}
+
+func TestPacerCapsBurstAfterStall(t *testing.T) {
+	const burst = 5
+	pacer, _ := stalledPacer(pacingConstant, burst)
+	quit := make(chan struct{})
+	immediate := 0
+	for i := 0; i < 30; i++ {
+		if pacer.Wait(0, quit) > 0 {
+			break
+		}
+		immediate += 1
+	}
+	// The timer slack (one interval at this rate) lets one more message catch up.
+	if immediate != burst+1 {
+		t.Errorf("constant pacing sent %d messages back to back after a stall, want %d", immediate, burst+1)
+	}
+}
+
+func TestPacerCapsPoissonBurstAfterStall(t *testing.T) {
+	const burst = 5
+	pacer, clock := stalledPacer(pacingPoisson, burst)
+	quit := make(chan struct{})
+	// Without a cap, the 30 messages would all be sent right away to catch up. With it, all but the burst
+	// (and the timer slack) follow at the rate, 240ms on average.
+	start := clock.now()
+	for i := 0; i < 30; i++ {
+		pacer.Wait(0, quit)
+	}
+	if elapsed := clock.now().Sub(start); elapsed < 120*time.Millisecond {
+		t.Errorf("Poisson pacing sent 30 messages in %v after a stall, want at least 120ms", elapsed)
+	}
+}
+
+func TestPacerResetSkipsCatchUp(t *testing.T) {
+	pacer, clock := newTestPacer(100, 50, pacingConstant, 1)
+	quit := make(chan struct{})
+	pacer.Wait(0, quit)
+	clock.t = clock.t.Add(200 * time.Millisecond)
+	pacer.Reset()
+	pacer.Wait(0, quit)
+	if waited := pacer.Wait(0, quit); waited != 10*time.Millisecond {
+		t.Errorf("pacer waited %v after a reset, want one interval", waited)
+	}
+}
+
+func TestRealtimePacerFollowsEventTime(t *testing.T) {
+	pacer, clock := newTestPacer(100, 1, pacingRealtime, 10)
+	quit := make(chan struct{})
+	tests := []struct {
+		// How much wall-clock time passes before the message.
+		stall     time.Duration
+		eventTime int64
+		want      time.Duration
+	}{
+		{0, 0, 0},
+		// At a time warp of 10, a simulated second passes in 100ms.
+		{0, 1000, 100 * time.Millisecond},
+		{0, 3000, 200 * time.Millisecond},
+		// Messages slightly out of order are sent right away, without starting over.
+		{0, 2500, 0},
+		{0, 4000, 100 * time.Millisecond},
+		// After falling behind by more than maxRealtimeLag, the replay starts over instead of catching up.
+		{5 * time.Second, 5000, 0},
+		{0, 6000, 100 * time.Millisecond},
+		// As it does when the replay jumps back, e.g., when it loops.
+		{0, -3600000, 0},
+		{0, -3599000, 100 * time.Millisecond},
+	}
+	for i, test := range tests {
+		clock.t = clock.t.Add(test.stall)
+		if waited := pacer.Wait(test.eventTime, quit); waited != test.want {
+			t.Errorf("message %d at %d ms waited %v, want %v", i, test.eventTime, waited, test.want)
+		}
+	}
+
+	pacer.SetTimeWarp(100)
+	pacer.Wait(0, quit)
+	if waited := pacer.Wait(1000, quit); waited != 10*time.Millisecond {
+		t.Errorf("a simulated second passed in %v after changing the time warp to 100, want 10ms", waited)
+	}
+}
@@ -0,0 +1,144 @@
+package taxisite
+
+import (
+	"errors"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/twpayne/go-polyline"
+	"taxistream/base"
+	"taxistream/storage"
+	"taxistream/taxisim"
+)
+
+// A route together with its decoded geometry, so that positions along it can be interpolated
+// without decoding the polyline again for every time slice.
+type preparedRoute struct {
+	base.Route
+	Coords     [][]float64
+	CumLengths []float64
+}
+
+// Decodes the geometry of a route and computes its cumulative lengths.
+func prepareRoute(route base.Route) (*preparedRoute, error) {
+	coords, _, err := polyline.DecodeCoords([]byte(route.Geometry))
+	if err != nil {
+		return nil, err
+	}
+	if len(coords) == 0 {
+		return nil, errors.New("route " + strconv.FormatInt(route.Id, 10) + " has no geometry")
+	}
+	return &preparedRoute{route, coords, taxisim.CumulativeLengths(coords)}, nil
+}
+
+// The length of the route geometry in meters.
+func (r *preparedRoute) Length() float64 {
+	return r.CumLengths[len(r.CumLengths)-1]
+}
+
+// The position of the taxi after travelling the given fraction of the route.
+func (r *preparedRoute) Along(perc float64) (float64, float64) {
+	return taxisim.AlongPolylineCumulative(r.Length()*perc, r.Coords, r.CumLengths)
+}
+
+// The movement of the taxi after travelling the given fraction of the route: its heading (in degrees clockwise
+// from north) and how many meters it has travelled.
+func (r *preparedRoute) Movement(perc float64) (float64, float64) {
+	travelled := r.Length() * perc
+	_, _, _, heading := taxisim.AlongPolylineSegment(travelled, r.Coords, r.CumLengths)
+	return heading, travelled
+}
+
+// An in-memory index over [PuTime, DoTime] of all routes of a dataset.
+//
+// Routes are sorted by pickup time. The routes intersecting a window are the ones that start within it, which
+// are a contiguous range, and the ones that start before it and end after its start. The latter are found with
+// range maximum queries over the dropoff times (a sparse table), each of which either finds such a route or
+// rules out a whole range. Lookups thus take O(log n + k) for k routes in the window.
+type routeIndex struct {
+	routes []*preparedRoute
+	// latest[j][i] is the route with the latest dropoff time among routes[i : i+2^j].
+	latest [][]int32
+}
+
+// Loads all routes from the store into a route index.
+func loadRouteIndex(store storage.MovementStore) (*routeIndex, error) {
+	routes, err := store.GetRoutes(time.Time{}, time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC), []int64{})
+	if err != nil {
+		return nil, err
+	}
+	prepared := make([]*preparedRoute, 0, len(routes))
+	for _, r := range routes {
+		p, err := prepareRoute(r)
+		if err != nil {
+			return nil, err
+		}
+		prepared = append(prepared, p)
+	}
+	return newRouteIndex(prepared), nil
+}
+
+// Builds a route index over the given routes.
+func newRouteIndex(routes []*preparedRoute) *routeIndex {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].PuTime.Before(routes[j].PuTime) })
+	index := &routeIndex{routes: routes}
+	level := make([]int32, len(routes))
+	for i := range level {
+		level[i] = int32(i)
+	}
+	for width := 1; len(level) > 0; width *= 2 {
+		index.latest = append(index.latest, level)
+		next := make([]int32, 0, len(level))
+		for i := 0; i+2*width <= len(routes); i++ {
+			next = append(next, index.later(level[i], level[i+width]))
+		}
+		level = next
+	}
+	return index
+}
+
+// The route of the two that ends later.
+func (index *routeIndex) later(i int32, j int32) int32 {
+	if index.routes[j].DoTime.After(index.routes[i].DoTime) {
+		return j
+	}
+	return i
+}
+
+// The route with the latest dropoff time among routes[lo:hi], which must not be empty.
+func (index *routeIndex) latestIn(lo int, hi int) int {
+	level := bits.Len(uint(hi-lo)) - 1
+	return int(index.later(index.latest[level][lo], index.latest[level][hi-1<<level]))
+}
+
+// Gets all routes intersecting the window (windowStart, windowEnd), in order of their pickup time.
+func (index *routeIndex) Query(windowStart time.Time, windowEnd time.Time) []*preparedRoute {
+	result := make([]*preparedRoute, 0)
+	// The routes that start before the window (or at its start), which intersect it if they end after its start.
+	started := sort.Search(len(index.routes), func(i int) bool {
+		puTime := index.routes[i].PuTime
+		return puTime.After(windowStart) || !puTime.Before(windowEnd)
+	})
+	index.endingAfter(0, started, windowStart, &result)
+	for i := started; i < len(index.routes) && index.routes[i].PuTime.Before(windowEnd); i++ {
+		result = append(result, index.routes[i])
+	}
+	return result
+}
+
+// Appends the routes among routes[lo:hi] that end after t, in order.
+func (index *routeIndex) endingAfter(lo int, hi int, t time.Time, result *[]*preparedRoute) {
+	if lo >= hi {
+		return
+	}
+	latest := index.latestIn(lo, hi)
+	// No route in this range ends after t.
+	if !index.routes[latest].DoTime.After(t) {
+		return
+	}
+	index.endingAfter(lo, latest, t, result)
+	*result = append(*result, index.routes[latest])
+	index.endingAfter(latest+1, hi, t, result)
+}
@@ -0,0 +1,136 @@
+package taxisite
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"taxistream/base"
+)
+
+// Gets the IDs of the routes intersecting the window (windowStart, windowEnd) by looking at every route.
+func scanRoutes(routes []*preparedRoute, windowStart time.Time, windowEnd time.Time) []int64 {
+	ids := make([]int64, 0)
+	for _, r := range routes {
+		if r.PuTime.Before(windowEnd) && r.DoTime.After(windowStart) {
+			ids = append(ids, r.Id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func queryIds(index *routeIndex, windowStart time.Time, windowEnd time.Time) []int64 {
+	ids := make([]int64, 0)
+	for _, r := range index.Query(windowStart, windowEnd) {
+		ids = append(ids, r.Id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func equalIds(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRouteIndexMatchesLinearScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	routes := make([]*preparedRoute, 0)
+	for i := 0; i < 500; i++ {
+		puTime := random.Intn(3600)
+		// Some routes have a duration of zero, some are long.
+		duration := random.Intn(4) * random.Intn(600)
+		routes = append(routes, &preparedRoute{Route: base.Route{Id: int64(i), PuTime: at(puTime),
+			DoTime: at(puTime + duration)}})
+	}
+	index := newRouteIndex(append([]*preparedRoute{}, routes...))
+
+	windows := [][2]int{{0, 3600}, {-100, 0}, {3600, 4200}, {-1000, 10000}}
+	for i := 0; i < 300; i++ {
+		windowStart := random.Intn(4000) - 200
+		windows = append(windows, [2]int{windowStart, windowStart + random.Intn(120)})
+	}
+	// Windows bounded by the pickup and dropoff times of routes, including empty ones.
+	for _, r := range routes[:50] {
+		puTime := int(r.PuTime.Sub(start).Seconds())
+		doTime := int(r.DoTime.Sub(start).Seconds())
+		windows = append(windows, [2]int{puTime, doTime}, [2]int{doTime, doTime + 15},
+			[2]int{puTime - 15, puTime}, [2]int{puTime, puTime})
+	}
+
+	for _, w := range windows {
+		want := scanRoutes(routes, at(w[0]), at(w[1]))
+		got := queryIds(index, at(w[0]), at(w[1]))
+		if !equalIds(got, want) {
+			t.Errorf("window (%d, %d): index returned %v, scan %v", w[0], w[1], got, want)
+		}
+	}
+}
+
+func TestRouteIndexQueryIsOrderedByPickup(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	routes := []*preparedRoute{
+		{Route: base.Route{Id: 1, PuTime: start.Add(20 * time.Second), DoTime: start.Add(40 * time.Second)}},
+		{Route: base.Route{Id: 2, PuTime: start, DoTime: start.Add(time.Minute)}},
+		{Route: base.Route{Id: 3, PuTime: start.Add(10 * time.Second), DoTime: start.Add(10 * time.Second)}},
+	}
+	result := newRouteIndex(routes).Query(start, start.Add(time.Minute))
+	if len(result) != 3 || result[0].Id != 2 || result[1].Id != 3 || result[2].Id != 1 {
+		t.Errorf("query returned routes in the wrong order")
+	}
+	if len(newRouteIndex(nil).Query(start, start.Add(time.Minute))) != 0 {
+		t.Errorf("empty index returned routes")
+	}
+}
+
+// The given number of routes, a thousand per hour with durations of up to half an hour, as in the taxi data.
+func benchmarkRoutes(n int) []*preparedRoute {
+	random := rand.New(rand.NewSource(1))
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := int64(n) * int64(time.Hour) / 1000
+	routes := make([]*preparedRoute, 0, n)
+	for i := 0; i < n; i++ {
+		puTime := start.Add(time.Duration(random.Int63n(span)))
+		routes = append(routes, &preparedRoute{Route: base.Route{Id: int64(i), PuTime: puTime,
+			DoTime: puTime.Add(time.Duration(random.Int63n(int64(30 * time.Minute))))}})
+	}
+	return routes
+}
+
+// Queries windows of a second at a constant number of routes in them, but over datasets of growing length.
+// Lookups grow only with the logarithm of the dataset size, while a linear scan grows with its size.
+func BenchmarkRouteIndexQuery(b *testing.B) {
+	for _, n := range []int{10000, 100000, 1000000} {
+		routes := benchmarkRoutes(n)
+		index := newRouteIndex(append([]*preparedRoute{}, routes...))
+		start := time.Date(2016, 1, 1, 1, 0, 0, 0, time.UTC)
+		span := time.Duration(n/1000-2) * time.Hour
+		b.Run("index/"+strconv.Itoa(n), func(b *testing.B) {
+			found := 0
+			for i := 0; i < b.N; i++ {
+				windowStart := start.Add(time.Duration(i) * 7919 * time.Second % span)
+				found += len(index.Query(windowStart, windowStart.Add(time.Second)))
+			}
+			b.ReportMetric(float64(found)/float64(b.N), "routes/op")
+		})
+		b.Run("scan/"+strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				windowStart := start.Add(time.Duration(i) * 7919 * time.Second % span)
+				scanRoutes(routes, windowStart, windowStart.Add(time.Second))
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package taxisite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long shutting down may take at most in total, to send the messages that are still queued and to close
+// the clients.
+const shutdownTimeout = 10 * time.Second
+
+// Blocks until an interrupt or termination signal is received, or until a server fails.
+func waitForShutdown(serverErrors chan error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		fmt.Println("Received", sig, "signal, shutting down.")
+	case err := <-serverErrors:
+		fmt.Println("Error (serving):", err)
+	}
+}
+
+// Shuts the application down: no more connections are accepted, the trackpoint preparation is stopped,
+// the updates still queued are sent, and finally all clients are closed.
+func shutDown(server *http.Server, listener net.Listener) {
+	if listener != nil {
+		listener.Close()
+	}
+	// All steps share the deadline, so that shutting down takes at most shutdownTimeout in total.
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	// This does not close WebSockets, they are closed together with the other clients below.
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Error (shutting down HTTP server):", err)
+	}
+
+	trackpointPrepper.Stop()
+	close(clientRequestStreamer.quit)
+	if discarded := streamer.Stop(time.Until(deadline)); discarded > 0 {
+		fmt.Println("Discarded", discarded, "queued updates.")
+	}
+
+	streamer.Clients.Close(time.Until(deadline))
+	clientRequestStreamer.Clients.Close(time.Until(deadline))
+	if clientRequestStreamer.Log != nil {
+		clientRequestStreamer.Log.Close()
+	}
+	fmt.Println("Shut down.")
+}
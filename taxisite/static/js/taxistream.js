@@ -149,11 +149,12 @@ $(function () {
             container.append("<p>Socket is open</p>");
         };
         socket.onmessage = function (e) {
-            var data = JSON.parse(e.data);
+            var message = JSON.parse(e.data);
+            var data = message["payload"];
             if (!(data["taxiId"] in taxiData)) {
                 taxiData[data["taxiId"]] = createNewTaxi(data["taxiId"]);
             }
-            if ("lon" in data && "lat" in data) {
+            if (message["type"] === "taxiLocation") {
                 taxiData[data["taxiId"]].lon = data["lon"];
                 taxiData[data["taxiId"]].lat = data["lat"];
             }
@@ -167,7 +168,7 @@ $(function () {
                 data["reservationLon"] !== null && data["reservationLat"] !== null) {
                 taxiData[data["taxiId"]].status = "reserved";
             }
-            if ("totalAmount" in data) {
+            if (message["type"] === "taxiRouteCompleted") {
                 taxiData[data["taxiId"]].status = "empty";
             }
             taxiLayer.needRedraw();
@@ -181,7 +182,11 @@ $(function () {
     function initClientWS() {
         var socket = new WebSocket("ws://" + window.location.hostname + ":" + websocketPort + "/ws-clients");
         socket.onmessage = function (e) {
-            var data = JSON.parse(e.data);
+            var message = JSON.parse(e.data);
+            if (message['type'] !== 'clientRequest') {
+                return;
+            }
+            var data = message['payload'];
             clientRequest['clientId'] = data['clientId'];
             clientRequest['origLon'] = data['origLon'];
             clientRequest['origLat'] = data['origLat'];
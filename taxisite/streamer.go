@@ -2,24 +2,179 @@ package taxisite
 
 import (
 	"container/ring"
-	"net"
 	"taxistream/base"
-	"github.com/gorilla/websocket"
+	"taxistream/messages"
 	"time"
 	"fmt"
 	"encoding/csv"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"encoding/binary"
+	"errors"
+	"net/url"
 )
 
 // The streamer simply takes the messages produced by the trackpoint preparation component
 // and pushes them out to interested parties.
 type Streamer struct {
-	WebsocketChannel  map[*websocket.Conn]bool
-	TCPChannel map[*net.Conn]bool
-	TaxiupdateChannel *chan []byte
-	ChannelUpdates    *ring.Ring
+	// The WebSocket and TCP clients of the stream.
+	Clients           *Hub
+	TaxiupdateChannel *chan *messages.Envelope
+	// The times between the last sent messages (in ns), to measure the throughput.
+	ChannelUpdates *ring.Ring
+	// Decides when the next message is sent.
+	Pacer *Pacer
+	// Assigns client requests to the free taxis of the stream, if enabled.
+	Matcher *Matcher
+	// The sequence number of the last message sent on the taxi stream, i.e., the number of messages sent.
+	// Accessed atomically.
+	Seq int64
+	// The event time of the last message sent on the taxi stream, i.e., the current simulated time of the stream.
+	// Accessed atomically, as other streams are timestamped with it.
+	EventTime int64
+	// Written into the header of Avro-encoded messages.
+	AvroSchemaId int32
+	// The size of the queue of every client, and what happens when it is full.
+	ClientQueueSize    int
+	SlowConsumerPolicy string
+
+	// While paused, no messages are sent. Guarded by pauseMutex, resumed is signalled when unpausing.
+	paused     bool
+	pauseMutex sync.Mutex
+	resumed    *sync.Cond
+
+	// Closed to stop sending messages. Once the streamer stopped, stopped is closed.
+	quit    chan struct{}
+	stopped chan struct{}
+}
+
+// Pauses or resumes sending messages.
+func (streamer *Streamer) SetPaused(paused bool) {
+	streamer.pauseMutex.Lock()
+	streamer.paused = paused
+	streamer.pauseMutex.Unlock()
+	streamer.resumed.Broadcast()
+}
+
+// Checks if the streamer is paused.
+func (streamer *Streamer) IsPaused() bool {
+	streamer.pauseMutex.Lock()
+	defer streamer.pauseMutex.Unlock()
+	return streamer.paused
+}
+
+// Blocks while the streamer is paused. Returns true if it had to wait.
+func (streamer *Streamer) waitWhilePaused() bool {
+	streamer.pauseMutex.Lock()
+	defer streamer.pauseMutex.Unlock()
+	waited := false
+	for streamer.paused {
+		streamer.resumed.Wait()
+		waited = true
+	}
+	return waited
+}
+
+// Keeps sending the queued messages for at most the given time (unless paused), then stops the streamer.
+// Returns the number of messages that were discarded.
+func (streamer *Streamer) Stop(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for !streamer.IsPaused() && len(*streamer.TaxiupdateChannel) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(streamer.quit)
+	discarded := streamer.flush()
+	// A paused streamer has to be woken up to notice that it is stopped.
+	streamer.SetPaused(false)
+	<-streamer.stopped
+	return discarded
+}
+
+// Discards all queued messages, returning how many there were.
+func (streamer *Streamer) flush() int {
+	flushed := 0
+	for {
+		select {
+		case <-*streamer.TaxiupdateChannel:
+			flushed += 1
+		default:
+			return flushed
+		}
+	}
+}
+
+// What a connection subscribed to: which messages it receives, and how they are encoded.
+type subscription struct {
+	Encoder messages.Encoder
+	Filter  *Filter
+}
+
+// Creates a subscription from query parameters, see newEncoder (parameter "encoding") and parseFilter.
+func (streamer *Streamer) newSubscription(query url.Values) (*subscription, error) {
+	encoder, err := streamer.newEncoder(query.Get("encoding"))
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription{encoder, filter}, nil
+}
+
+// Creates the encoder for the given format. Defaults to JSON if no format is given.
+func (streamer *Streamer) newEncoder(format string) (messages.Encoder, error) {
+	switch format {
+	case "", messages.FormatJSON:
+		return messages.JSONEncoder{}, nil
+	case messages.FormatProtobuf:
+		return messages.ProtobufEncoder{}, nil
+	case messages.FormatAvro:
+		return messages.AvroEncoder{SchemaId: streamer.AvroSchemaId}, nil
+	default:
+		return nil, errors.New("unknown encoding '" + format + "', must be one of {'json', 'protobuf', 'avro'}")
+	}
+}
+
+// Encodes a message with the given encoder, unless it has already been encoded in that format.
+// Returns nil if the message cannot be encoded.
+func encodeOnce(u *messages.Envelope, encoder messages.Encoder, encoded map[string][]byte) []byte {
+	if b, ok := encoded[encoder.Format()]; ok {
+		return b
+	}
+	b, err := encoder.Encode(u)
+	if err != nil {
+		fmt.Println("Error (encoding message):", err)
+	}
+	encoded[encoder.Format()] = b
+	return b
+}
+
+// Queues a message for a client, if it subscribed to it.
+func send(client *streamClient, u *messages.Envelope, positions map[int32][2]float64,
+	encoded map[string][]byte) {
+	if !client.Sub.Filter.Matches(u, positions) {
+		return
+	}
+	if b := encodeOnce(u, client.Sub.Encoder, encoded); b != nil {
+		client.enqueue(outgoing{b, u.Ts.EventTime, u.Ts.EmitTime})
+	}
+}
+
+// Frames a message for a TCP stream. JSON messages are newline-delimited, binary messages
+// are prefixed with their length as 4-byte big-endian integer.
+func tcpFrame(b []byte, encoder messages.Encoder) []byte {
+	// The message is shared by all clients, so it is copied rather than appended to.
+	if encoder.Binary() {
+		frame := make([]byte, 4, 4+len(b))
+		binary.BigEndian.PutUint32(frame, uint32(len(b)))
+		return append(frame, b...)
+	}
+	frame := make([]byte, len(b), len(b)+1)
+	copy(frame, b)
+	return append(frame, '\n')
 }
 
 // Computes the average value in a ring of float64 values.
@@ -37,20 +192,48 @@ func ringAverage(ring *ring.Ring) float64 {
 
 // Sets up the streamer and lets it listen to potential updates on a channel.
 func setUpStreamer(conf base.Configuration) *Streamer {
-	websocketChannels := make(map[*websocket.Conn]bool, 0)
-	tcpChannels := make(map[*net.Conn]bool, 0)
-	taxiupdates := make(chan []byte, int32(conf.TargetSpeedPerSecond*conf.TrackpointPrepWindowSize*2))
-	channelUpdates := ring.New(100)
-	streamer := Streamer{websocketChannels, tcpChannels,
-		&taxiupdates, channelUpdates}
-
-	throughput := conf.TargetSpeedPerSecond
-	backoff := 30.0 //1000000000.0 / conf.TargetSpeedPerSecond
+	switch conf.SlowConsumerPolicy {
+	case "", policyDropOldest, policyDropNewest, policyDisconnect:
+	default:
+		panic("unknown slowConsumerPolicy '" + conf.SlowConsumerPolicy + "', use one of {'drop-oldest', 'drop-newest', 'disconnect'}")
+	}
+
+	switch conf.PacingProfile {
+	case "", pacingConstant, pacingPoisson, pacingRealtime:
+	default:
+		panic("unknown pacingProfile '" + conf.PacingProfile + "', use one of {'constant', 'poisson', 'realtime'}")
+	}
+
+	// Without padding, the number of updates is given by the data, so they can only be paced by their event time.
+	pacingProfile := conf.PacingProfile
+	if conf.ReplayMode == replayEventTime && pacingProfile != pacingRealtime {
+		fmt.Println("Pacing the stream in real time, as the replay mode is 'event-time'.")
+		pacingProfile = pacingRealtime
+	}
+
+	taxiupdates := make(chan *messages.Envelope, int32(conf.TargetSpeedPerSecond*conf.TrackpointPrepWindowSize*2))
+	channelUpdates := ring.New(1000)
+	pacer := newPacer(conf.TargetSpeedPerSecond, conf.PacingBurst, pacingProfile, conf.TimeWarp)
+	matcher, err := newMatcher(conf)
+	if err != nil {
+		panic(err)
+	}
+	streamer := Streamer{Clients: newHub("taxi"), TaxiupdateChannel: &taxiupdates, ChannelUpdates: channelUpdates, Pacer: pacer,
+		Matcher: matcher,
+		AvroSchemaId: conf.AvroSchemaId, ClientQueueSize: conf.ClientQueueSize, SlowConsumerPolicy: conf.SlowConsumerPolicy,
+		quit: make(chan struct{}), stopped: make(chan struct{})}
+	streamer.resumed = sync.NewCond(&streamer.pauseMutex)
+
 	lastSent := time.Now()
 	statsCounter := 0
 	reset := true
+	// Every message is encoded at most once per format, no matter how many connections requested it.
+	encoded := make(map[string][]byte, 3)
+	// The last known position of every taxi, to filter messages without position by location.
+	positions := make(map[int32][2]float64)
 
 	go func() {
+		defer close(streamer.stopped)
 		time.Sleep(3 * time.Second)
 		var writer *csv.Writer = nil
 		if conf.Log {
@@ -63,57 +246,50 @@ func setUpStreamer(conf base.Configuration) *Streamer {
 		}
 
 		for {
-			u := <-taxiupdates
-			if float64(len(taxiupdates)) > 0.95 * float64(cap(taxiupdates)) && strings.Contains(string(u), "\"lon\"") {
-				// The channel is almost full... this is a hack to simply let off some steam.
-				// TODO Remove this hack.
-			} else {
-				if len(streamer.WebsocketChannel) > 0 {
-					for c := range streamer.WebsocketChannel {
-						c.WriteMessage(websocket.TextMessage, u)
-					}
-				}
-				if len(streamer.TCPChannel) > 0 {
-					for c := range streamer.TCPChannel {
-						(*c).Write([]byte(append(u, []byte("\n")...)))
-					}
-				}
-				if reset {
-					lastSent = time.Now()
-					reset = false
-				}
-				streamer.ChannelUpdates = streamer.ChannelUpdates.Next()
-				streamer.ChannelUpdates.Value = float64(time.Now().Sub(lastSent).Nanoseconds())
+			var u *messages.Envelope
+			select {
+			case u = <-taxiupdates:
+			case <-streamer.quit:
+				return
+			}
+			// After a pause, the schedule and the throughput measurement start over.
+			if streamer.waitWhilePaused() {
+				pacer.Reset()
+				reset = true
+			}
+			waited := pacer.Wait(u.Ts.EventTime, streamer.quit)
+			u.Stamp(time.Now(), atomic.AddInt64(&streamer.Seq, 1))
+			atomic.StoreInt64(&streamer.EventTime, u.Ts.EventTime)
+			if p, ok := u.Payload.(*messages.TaxiUpdate); ok {
+				positions[p.TaxiId] = [2]float64{p.Lon, p.Lat}
+			}
+			if matcher != nil {
+				matcher.Observe(u)
+			}
+			clear(encoded)
+			streamer.Clients.Broadcast(func(client *streamClient) {
+				send(client, u, positions, encoded)
+			})
+			if reset {
 				lastSent = time.Now()
+				reset = false
+			}
+			streamer.ChannelUpdates = streamer.ChannelUpdates.Next()
+			streamer.ChannelUpdates.Value = float64(time.Now().Sub(lastSent).Nanoseconds())
+			lastSent = time.Now()
 
-				statsCounter += 1
-				if (statsCounter % 1000) == 0 {
-					fmt.Println("Sent 1000:", ringAverage(streamer.ChannelUpdates), throughput, backoff, len(taxiupdates))
-				}
-
+			statsCounter += 1
+			if (statsCounter % 1000) == 0 {
 				timePerMessage := ringAverage(streamer.ChannelUpdates)
-				throughput = 1000000000.0 / timePerMessage
-				processingTime := streamer.ChannelUpdates.Value.(float64) - backoff
-				targetProcTime := processingTime * conf.TargetSpeedPerSecond
-				backoff = (1000000000 - targetProcTime) / conf.TargetSpeedPerSecond
-
-				if conf.Log {
-					line := []string{strconv.FormatFloat(throughput, 'f', 5, 64),
-						strconv.FormatFloat(backoff, 'f', 5, 64),
-						strconv.FormatFloat(streamer.ChannelUpdates.Value.(float64), 'f', 5, 64),
-						strconv.Itoa(len(taxiupdates))}
-					writer.Write(line)
-				}
-
-				// If we exhaust the channel, reset to the target speed.
-				if len(taxiupdates) == 0 {
-					backoff = 1000000000.0 / conf.TargetSpeedPerSecond
-					streamer.ChannelUpdates = ring.New(1000)
-					reset = true
-				}
-				if backoff > 0 {
-					time.Sleep(time.Duration(backoff) * time.Nanosecond)
-				}
+				fmt.Println("Sent 1000:", timePerMessage, 1000000000.0/timePerMessage, waited.Nanoseconds(), len(taxiupdates))
+			}
+
+			if conf.Log {
+				line := []string{strconv.FormatFloat(1000000000.0/ringAverage(streamer.ChannelUpdates), 'f', 5, 64),
+					strconv.FormatFloat(float64(waited.Nanoseconds()), 'f', 5, 64),
+					strconv.FormatFloat(streamer.ChannelUpdates.Value.(float64), 'f', 5, 64),
+					strconv.Itoa(len(taxiupdates))}
+				writer.Write(line)
 			}
 		}
 	}()
@@ -3,16 +3,44 @@ package taxisite
 import (
 	"time"
 	"taxistream/base"
-	"database/sql"
 	"fmt"
-	"github.com/lib/pq"
+	"taxistream/messages"
+	"taxistream/storage"
 	"taxistream/taxisim"
-	"github.com/twpayne/go-polyline"
-	"encoding/json"
+	"math"
 	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
-// The trackpoint preparation component constantly retrieves routes from a database,
+// The format of the replay start and end times in the configuration.
+const replayTimeFormat = "2006-01-02 15:04:05"
+
+// What happens when the streamer cannot keep up with the generated updates: {'block', 'adapt', 'shed'}.
+// With 'block', the preparation waits for the streamer (and the replay falls behind the time warp). With 'adapt',
+// fewer updates are generated per window, and with 'shed', location updates are dropped while the queue is almost full.
+const (
+	backpressureBlock = "block"
+	backpressureAdapt = "adapt"
+	backpressureShed  = "shed"
+)
+
+// How full the update queue may get before location updates are shed.
+const shedWatermark = 0.95
+
+// How the updates of a window are generated: {'padded', 'event-time'}. With 'padded', there are as many updates
+// as needed to reach the target speed, repeating some of them if necessary. With 'event-time', every taxi reports
+// its location once per GPS interval, and the stream is paced by the time warp alone.
+const (
+	replayPadded    = "padded"
+	replayEventTime = "event-time"
+)
+
+// The simulated time between two location updates of a taxi in the 'event-time' replay mode, if none is configured.
+const defaultGPSInterval = 5.0
+
+// The trackpoint preparation component constantly retrieves routes from a movement store,
 // and generates taxi updates from it.
 //
 // As for now, this only supports location and occupancy updates. Later, things like
@@ -21,161 +49,236 @@ import (
 type TrackpointPrepper struct {
 	WindowStart   time.Time
 	WindowEnd     time.Time
-	Routes        []Route
+	Routes        []*preparedRoute
 	ReservedTaxis map[int32]bool
-}
 
-// A route as it is stored in the database.
-type Route struct {
-	Id     int64
-	TaxiId int32
-	PuTime time.Time
-	DoTime time.Time
-
-	PassengerCount       int32
-	Distance             float64
-	Duration             float64
-	FareAmount           float64
-	Extra                float64
-	MTATax               float64
-	TipAmount            float64
-	TollsAmount          float64
-	EHailFee             float64
-	ImprovementSurcharge float64
-	TotalAmount          float64
-	PaymentType          int32
-	TripType             int32
-
-	Geometry string
-
-	StartLon float64
-	StartLat float64
-	EndLon   float64
-	EndLat   float64
-}
+	// If the dataset is preloaded, routes are looked up in memory instead of querying the store on every tick.
+	RouteIndex *routeIndex
 
-// A taxi location update that is serialized as JSON and sent to interested parties.
-type TaxiUpdate struct {
-	TaxiId int32   `json:"taxiId"`
-	Lon    float64 `json:"lon"`
-	Lat    float64 `json:"lat"`
-
-	NumOccupants   int32    `json:"numOccupants"`
-	DestLon        *float64 `json:"destLon"`
-	DestLat        *float64 `json:"destLat"`
-	ReservationLon *float64 `json:"reservationLon"`
-	ReservationLat *float64 `json:"reservationLat"`
-}
+	// Adds GPS errors to the location updates, if configured.
+	Noise *gpsNoise
+	// How fast taxis drive along their routes at which time of the day.
+	Speeds *taxisim.SpeedModel
 
-// A taxi occupancy update.
-type TaxiOccupancyUpdate struct {
-	TaxiId       int32   `json:"taxiId"`
-	NumOccupants int32   `json:"numOccupants"`
-	DestLon      float64 `json:"destLon"`
-	DestLat      float64 `json:"destLat"`
-}
+	// The range of simulated time that is replayed.
+	ReplayStart time.Time
+	ReplayEnd   time.Time
 
-// Updates where a taxi will travel to (when it gets booked).
-type TaxiDestinationUpdate struct {
-	TaxiId       int32   `json:"taxiId"`
-	NumOccupants int32   `json:"numOccupants"`
-	DestLon      float64 `json:"destLon"`
-	DestLat      float64 `json:"destLat"`
-}
+	// How much faster than real time the replay runs, and how many updates per second are generated.
+	// Both can be changed at runtime through the control API.
+	TimeWarp    float64
+	TargetSpeed float64
+	WindowSize  float64
 
-// Update when a taxi receives a reservation.
-type TaxiReservationUpdate struct {
-	TaxiId         int32   `json:"taxiId"`
-	ReservationLon float64 `json:"reservationLon"`
-	ReservationLat float64 `json:"reservationLat"`
+	// Guards the window, routes and time warp, which the control API changes while trackpoints are prepared.
+	mutex sync.Mutex
+	// Incremented on every seek, so that updates prepared for the previous position are discarded.
+	generation int64
+	// Closed on the next seek, to wake the preparation up while it waits for space in the queue.
+	seeked chan struct{}
+	// Held while an update is checked against the generation and queued, so that a seek can flush the queue
+	// without an update for the previous position being queued afterwards.
+	sendMutex sync.Mutex
+
+	// The number of updates per second generated for the current window, which is less than the target speed
+	// if the streamer cannot keep up and the backpressure policy is 'adapt'. In the 'event-time' replay mode,
+	// it is however many updates the window contained.
+	GenerationRate float64
+	// The number of updates per second the streamer sent since the last window was prepared.
+	SendRate float64
+	// The number of sent updates when the last window was prepared, to measure the send rate. Reset while paused.
+	lastSeq     int64
+	lastSeqTime time.Time
+	// How many location updates were shed, and how long the preparation was blocked by a full queue in total.
+	// Accessed atomically.
+	shed         int64
+	blockedNanos int64
+
+	// Closed to stop the preparation. Once it stopped and closed the movement store, stopped is closed.
+	quit     chan struct{}
+	quitOnce sync.Once
+	stopped  chan struct{}
 }
 
-// When a taxi finishes serving a route, its price is sent.
-type TaxiRouteCompletedUpdate struct {
-	TaxiId               int32   `json:"taxiId"`
-	PassengerCount       int32   `json:"passengerCount"`
-	Distance             float64 `json:"tripDistance"`
-	Duration             float64 `json:"tripDuration"`
-	FareAmount           float64 `json:"fareAmount"`
-	Extra                float64 `json:"extra"`
-	MTATax               float64 `json:"mtaTax"`
-	TipAmount            float64 `json:"tipAmount"`
-	TollsAmount          float64 `json:"tollsAmount"`
-	EHailFee             float64 `json:"ehailFee"`
-	ImprovementSurcharge float64 `json:"improvementSurcharge"`
-	TotalAmount          float64 `json:"totalAmount"`
-	PaymentType          int32   `json:"paymentType"`
-	TripType             int32   `json:"tripType"`
+// Stops preparing trackpoints and waits until the movement store is closed.
+func (trackpointPrepper *TrackpointPrepper) Stop() {
+	trackpointPrepper.quitOnce.Do(func() { close(trackpointPrepper.quit) })
+	<-trackpointPrepper.stopped
 }
 
-// Sets up the connection to the database.
-func connectToDatabase(conf base.Configuration) *sql.DB {
-	dataSourceName := fmt.Sprintf("host=%s port=%s dbname=%s sslmode=%s user=%s password=%s",
-		conf.DbHost, conf.DbPort, conf.DbName, conf.DbSSLMode, conf.DbUser, conf.DbPassword)
-	db, err := sql.Open("postgres", dataSourceName)
-	if err != nil {
-		panic(err)
+// Gets the routes intersecting the current window that are not active yet, either from the route index
+// or from the movement store.
+func fetchRoutes(trackpointPrepper *TrackpointPrepper, store storage.MovementStore) []*preparedRoute {
+	active := make(map[int64]bool, len(trackpointPrepper.Routes))
+	ids := make([]int64, 0, len(trackpointPrepper.Routes))
+	for _, r := range trackpointPrepper.Routes {
+		active[r.Id] = true
+		ids = append(ids, r.Id)
 	}
-	err = db.Ping()
-	if err != nil {
-		panic(err)
+
+	if trackpointPrepper.RouteIndex != nil {
+		routes := make([]*preparedRoute, 0)
+		for _, r := range trackpointPrepper.RouteIndex.Query(trackpointPrepper.WindowStart, trackpointPrepper.WindowEnd) {
+			if !active[r.Id] {
+				routes = append(routes, r)
+			}
+		}
+		return routes
 	}
-	return db
-}
 
-// Gets the simulated routes from PostGIS.
-func getRoutes(windowStart time.Time, windowEnd time.Time, ids []int64, db *sql.DB) []Route {
-	rows, err := db.Query("SELECT id, taxi_id, pickup_time, dropoff_time, passenger_count, "+
-		"trip_distance, trip_duration, fare_amount, extra, mta_tax, tip_amount, tolls_amount, ehail_fee, "+
-		"improvement_surcharge, total_amount, payment_type, trip_type, ST_AsEncodedPolyline(geometry), "+
-		"ST_X(ST_StartPoint(geometry)), ST_Y(ST_StartPoint(geometry)), "+
-		"ST_X(ST_EndPoint(geometry)), ST_Y(ST_EndPoint(geometry)) "+
-		"FROM taxi_routes WHERE dropoff_time > $1 AND pickup_time < $2 AND id <> ALL ($3)",
-		windowStart, windowEnd, pq.Int64Array(ids))
-	defer rows.Close()
+	storedRoutes, err := store.GetRoutes(trackpointPrepper.WindowStart, trackpointPrepper.WindowEnd, ids)
 	if err != nil {
 		fmt.Println("Error (with query):", err)
 		panic(err)
 	}
-
-	routes := make([]Route, 0)
-	for rows.Next() {
-		route := Route{}
-		err := rows.Scan(&route.Id, &route.TaxiId, &route.PuTime, &route.DoTime, &route.PassengerCount,
-			&route.Distance, &route.Duration, &route.FareAmount, &route.Extra, &route.MTATax, &route.TipAmount,
-			&route.TollsAmount, &route.EHailFee, &route.ImprovementSurcharge, &route.TotalAmount,
-			&route.PaymentType, &route.TripType, &route.Geometry, &route.StartLon, &route.StartLat,
-			&route.EndLon, &route.EndLat)
+	routes := make([]*preparedRoute, 0, len(storedRoutes))
+	for _, sr := range storedRoutes {
+		r, err := prepareRoute(sr)
 		if err != nil {
-			fmt.Println("Error (parsing route data):", err)
+			panic(err)
 		}
-		routes = append(routes, route)
-	}
-	err = rows.Err()
-	if err != nil {
-		panic(err)
+		routes = append(routes, r)
 	}
 	return routes
 }
 
-// Gets routes from a database, and transforms them into the appropriate number of taxi update
+// Determines how many updates per second to generate for the next window. This is the target speed, unless
+// the backpressure policy is 'adapt' and the streamer could not send the last window in time (i.e., more than
+// a tenth of a window is still queued). Then, it is what the streamer managed to send, reduced such that
+// the excess queued updates are sent within the next window.
+func generationRate(trackpointPrepper *TrackpointPrepper, streamer *Streamer, conf base.Configuration) float64 {
+	now := time.Now()
+	seq := atomic.LoadInt64(&streamer.Seq)
+	if !trackpointPrepper.lastSeqTime.IsZero() {
+		trackpointPrepper.SendRate = float64(seq-trackpointPrepper.lastSeq) / now.Sub(trackpointPrepper.lastSeqTime).Seconds()
+	}
+	trackpointPrepper.lastSeq = seq
+	trackpointPrepper.lastSeqTime = now
+
+	rate := trackpointPrepper.TargetSpeed
+	windowSize := trackpointPrepper.WindowSize
+	excess := float64(len(*streamer.TaxiupdateChannel)) - 0.1*rate*windowSize
+	if conf.BackpressurePolicy == backpressureAdapt && excess > 0 && trackpointPrepper.SendRate > 0 {
+		sendRate := trackpointPrepper.SendRate
+		rate = math.Max(math.Min(rate, sendRate-excess/windowSize), 0.1*sendRate)
+	}
+	return rate
+}
+
+// The simulated time covered by a single trackpoint preparation window.
+func windowDuration(trackpointPrepper *TrackpointPrepper) time.Duration {
+	return time.Duration(trackpointPrepper.WindowSize * trackpointPrepper.TimeWarp * float64(time.Second))
+}
+
+// Moves the window to the given start time and forgets about all active routes and reservations.
+func resetWindow(trackpointPrepper *TrackpointPrepper, windowStart time.Time) {
+	trackpointPrepper.WindowStart = windowStart
+	trackpointPrepper.WindowEnd = windowStart.Add(windowDuration(trackpointPrepper))
+	trackpointPrepper.Routes = make([]*preparedRoute, 0)
+	trackpointPrepper.ReservedTaxis = make(map[int32]bool)
+}
+
+// Gets routes from the movement store, and transforms them into the appropriate number of taxi update
 // messages. These are then sent to the streamer component of the application.
-func prepTrackpoints(trackpointPrepper *TrackpointPrepper, streamer *Streamer, db *sql.DB, conf base.Configuration) {
-	fmt.Println("TrackpointPrepper:", trackpointPrepper.WindowStart, "-", trackpointPrepper.WindowEnd)
-	windowSize := conf.TrackpointPrepWindowSize
-	timeWarp := conf.TimeWarp
-	targetSpeed := conf.TargetSpeedPerSecond
+//
+// Returns true once the end of the replay range is reached and the replay should stop.
+func prepTrackpoints(trackpointPrepper *TrackpointPrepper, streamer *Streamer, store storage.MovementStore,
+	conf base.Configuration) bool {
+	trackpointPrepper.mutex.Lock()
+	trackpointPrepper.GenerationRate = generationRate(trackpointPrepper, streamer, conf)
+	updates, stop := prepWindow(trackpointPrepper, store, conf)
+	if trackpointPrepper.Noise != nil {
+		updates = trackpointPrepper.Noise.Apply(updates)
+	}
+	if conf.ReplayMode == replayEventTime {
+		// The number of updates follows from the simulated data instead of the target speed.
+		trackpointPrepper.GenerationRate = float64(len(updates)) / trackpointPrepper.WindowSize
+	}
+	generation, seeked := trackpointPrepper.generation, trackpointPrepper.seeked
+	trackpointPrepper.mutex.Unlock()
 
-	// Get all currently active routes.
-	ids := make([]int64, 0)
-	for _, r := range trackpointPrepper.Routes {
-		ids = append(ids, r.Id)
+	// Sending blocks while the streamer is busy, so this must not hold the lock.
+	taxiupdates := *streamer.TaxiupdateChannel
+	totCnt := 0
+	for _, u := range updates {
+		queued, quit := trackpointPrepper.enqueue(taxiupdates, u, generation, seeked, conf)
+		if quit {
+			return true
+		}
+		if queued {
+			totCnt += 1
+		} else if atomic.LoadInt64(&trackpointPrepper.generation) != generation {
+			fmt.Println("TrackpointPrepper: discarding updates prepared before seek.")
+			break
+		}
+	}
+	if len(updates) > 0 {
+		fmt.Println("Added messages", totCnt)
+	}
+	return stop
+}
+
+// Puts an update prepared for the given generation into the queue, unless it was shed or a seek happened
+// in the meantime. Returns whether it was queued, and whether the preparation was stopped while waiting.
+func (trackpointPrepper *TrackpointPrepper) enqueue(taxiupdates chan *messages.Envelope, u *messages.Envelope,
+	generation int64, seeked chan struct{}, conf base.Configuration) (bool, bool) {
+	trackpointPrepper.sendMutex.Lock()
+	defer trackpointPrepper.sendMutex.Unlock()
+	if atomic.LoadInt64(&trackpointPrepper.generation) != generation {
+		return false, false
+	}
+	// Only location updates are shed, all others change the state of a taxi.
+	if conf.BackpressurePolicy == backpressureShed && u.Type == messages.TypeTaxiLocation &&
+		float64(len(taxiupdates)) > shedWatermark*float64(cap(taxiupdates)) {
+		atomic.AddInt64(&trackpointPrepper.shed, 1)
+		return false, false
+	}
+	select {
+	case taxiupdates <- u:
+		return true, false
+	default:
+	}
+	blockedSince := time.Now()
+	defer func() {
+		atomic.AddInt64(&trackpointPrepper.blockedNanos, int64(time.Since(blockedSince)))
+	}()
+	select {
+	case taxiupdates <- u:
+		return true, false
+	case <-seeked:
+		return false, false
+	case <-trackpointPrepper.quit:
+		return false, true
+	}
+}
+
+// Generates the updates for the current window and moves the window forward.
+// Returns true once the end of the replay range is reached and the replay should stop.
+func prepWindow(trackpointPrepper *TrackpointPrepper, store storage.MovementStore,
+	conf base.Configuration) ([]*messages.Envelope, bool) {
+	if !trackpointPrepper.WindowStart.Before(trackpointPrepper.ReplayEnd) {
+		switch conf.ReplayEndBehaviour {
+		case "stop":
+			fmt.Println("TrackpointPrepper: end of replay range reached, stopping.")
+			return nil, true
+		case "idle":
+			return nil, false
+		default:
+			fmt.Println("TrackpointPrepper: end of replay range reached, looping.")
+			resetWindow(trackpointPrepper, trackpointPrepper.ReplayStart)
+		}
 	}
-	routes := getRoutes(trackpointPrepper.WindowStart, trackpointPrepper.WindowEnd, ids, db)
+
+	fmt.Println("TrackpointPrepper:", trackpointPrepper.WindowStart, "-", trackpointPrepper.WindowEnd)
+	windowSize := trackpointPrepper.WindowSize
+	timeWarp := trackpointPrepper.TimeWarp
+	rate := trackpointPrepper.GenerationRate
+
+	routes := fetchRoutes(trackpointPrepper, store)
 
 	// Get new set of active routes.
 	trackpointPrepper.Routes = append(trackpointPrepper.Routes, routes...)
-	newRoutes := make([]Route, 0)
+	newRoutes := make([]*preparedRoute, 0)
 	for _, r := range trackpointPrepper.Routes {
 		if !r.DoTime.Before(trackpointPrepper.WindowStart) {
 			newRoutes = append(newRoutes, r)
@@ -186,14 +289,17 @@ func prepTrackpoints(trackpointPrepper *TrackpointPrepper, streamer *Streamer, d
 	trackpointPrepper.Routes = newRoutes
 	fmt.Println("TrackpointPrepper.Routes.len:", len(trackpointPrepper.Routes))
 
-	if len(trackpointPrepper.Routes) > int(conf.NumTaxis / 10) {
-		// Create updates for all taxis. First, compute how many updates we need to reach the target speed.
-		numUpdates := windowSize * targetSpeed
+	paddedUpdates := make([]*messages.Envelope, 0)
+	if conf.ReplayMode == replayEventTime {
+		paddedUpdates = eventTimeUpdates(trackpointPrepper, conf)
+	} else if len(trackpointPrepper.Routes) > 0 {
+		// Create updates for all taxis. First, compute how many updates we need to reach the generation rate.
+		numUpdates := windowSize * rate
 		numTimeSlices := numUpdates / float64(len(trackpointPrepper.Routes))
 		timeInc := time.Duration(1000000000.0*windowSize*timeWarp/numTimeSlices) * time.Nanosecond
 
 		timeSlice := trackpointPrepper.WindowStart
-		updates := make([][]byte, 0)
+		updates := make([]*messages.Envelope, 0)
 		for timeSlice.Before(trackpointPrepper.WindowEnd) {
 			sliceEnd := timeSlice.Add(timeInc)
 
@@ -202,24 +308,12 @@ func prepTrackpoints(trackpointPrepper *TrackpointPrepper, streamer *Streamer, d
 				// If it's a route with passengers, a destination message has to be added too.
 				if r.PuTime.After(timeSlice) && r.PuTime.Before(sliceEnd) {
 					// This is a new route, we have to generate an occupancy message.
-					// Since we include all messages in both streams, here we kinda redundantly send both messages.
-					o, _ := json.Marshal(TaxiOccupancyUpdate{r.TaxiId, r.PassengerCount,
-						r.EndLon, r.EndLat})
-					updates = append(updates, o)
-
-					b, _ := json.Marshal(TaxiDestinationUpdate{r.TaxiId, r.PassengerCount,
-						r.EndLon, r.EndLat})
-					updates = append(updates, b)
+					updates = append(updates, routeStartUpdates(r, timeSlice)...)
 				}
 
 				// Check if this route is just stopping now. If so, we have to send the journey (esp. price) information.
 				if r.DoTime.After(timeSlice) && r.DoTime.Before(sliceEnd) {
-					b, _ := json.Marshal(TaxiRouteCompletedUpdate{r.TaxiId, r.PassengerCount,
-						r.Distance, r.Duration, r.FareAmount, r.Extra,
-						r.MTATax, r.TipAmount, r.TollsAmount, r.EHailFee,
-						r.ImprovementSurcharge, r.TotalAmount, r.PaymentType,
-						r.TripType})
-					updates = append(updates, b)
+					updates = append(updates, routeEndUpdates(r, timeSlice)...)
 					delete(trackpointPrepper.ReservedTaxis, r.TaxiId)
 				}
 
@@ -228,39 +322,13 @@ func prepTrackpoints(trackpointPrepper *TrackpointPrepper, streamer *Streamer, d
 				// For now, we do this approx. for one taxi every 10 seconds.
 				if r.PassengerCount == 0 && rand.Float64() < 1.0 /
 					(10000000000.0/float64(timeInc.Nanoseconds())*float64(len(trackpointPrepper.Routes))) {
-					trackpointPrepper.ReservedTaxis[r.TaxiId] = true
-					b, _ := json.Marshal(TaxiReservationUpdate{r.TaxiId, r.EndLon, r.EndLat})
-					updates = append(updates, b)
+					updates = append(updates, reserve(trackpointPrepper, r, timeSlice))
 				}
 
 				// In any case, we want to generate some location updates.
-				// TODO Auf UNIX / Mac scheint es anders kodiert zu sein, d.h. das strings Replace ist nicht nötig.
-				// TODO Auf Ubuntu geht es so (gleich wie Windows).
-				coords, _, err := polyline.DecodeCoords([]byte(r.Geometry))
-				// coords, _, err := polyline.DecodeCoords([]byte(strings.Replace(r.Geometry, "\\\\", "\\", -1)))
-				if err != nil {
-					panic(err)
-				}
 				perc := timeSlice.Sub(r.PuTime).Seconds() / r.DoTime.Sub(r.PuTime).Seconds()
 				if perc > 0 && perc < 1 {
-					lon, lat := taxisim.AlongPolyline(taxisim.PolylineLength(coords)*perc, coords)
-					if streamer.TaxiupdateChannel != nil {
-						var resLon *float64
-						var resLat *float64
-						if trackpointPrepper.ReservedTaxis[r.TaxiId] {
-							resLon = &r.EndLon
-							resLat = &r.EndLat
-						}
-						if r.PassengerCount > 0 {
-							b, _ := json.Marshal(TaxiUpdate{r.TaxiId, lon, lat,
-								r.PassengerCount, &r.EndLon, &r.EndLat, resLon, resLat})
-							updates = append(updates, b)
-						} else {
-							b, _ := json.Marshal(TaxiUpdate{r.TaxiId, lon, lat,
-								r.PassengerCount, nil, nil, resLon, resLat})
-							updates = append(updates, b)
-						}
-					}
+					updates = append(updates, locationUpdate(trackpointPrepper, r, timeSlice))
 				}
 			}
 			timeSlice = timeSlice.Add(timeInc)
@@ -270,51 +338,242 @@ func prepTrackpoints(trackpointPrepper *TrackpointPrepper, streamer *Streamer, d
 		missingUpdates := int(numUpdates) - len(updates)
 		updateCount := float64(len(updates)) / float64(missingUpdates)
 		cnt := 0.0
-		totCnt := 0
 		for _, r := range updates {
-			*streamer.TaxiupdateChannel <- r
-			totCnt += 1
+			paddedUpdates = append(paddedUpdates, r)
 			if updateCount > 0 && cnt > updateCount {
-				*streamer.TaxiupdateChannel <- r
-				totCnt += 1
+				paddedUpdates = append(paddedUpdates, r)
 				cnt -= updateCount
 			}
 
 			cnt += 1
 		}
-		fmt.Println("Added messages", totCnt)
+	}
+
+	trackpointPrepper.WindowStart = trackpointPrepper.WindowEnd
+	trackpointPrepper.WindowEnd = trackpointPrepper.WindowEnd.Add(windowDuration(trackpointPrepper))
+	return paddedUpdates, false
+}
+
+// Generates the updates for the current window in the 'event-time' replay mode: every taxi reports its location
+// every GPS interval (in simulated time), and pickups, dropoffs and reservations happen when they happen.
+// The updates are ordered by event time.
+func eventTimeUpdates(trackpointPrepper *TrackpointPrepper, conf base.Configuration) []*messages.Envelope {
+	interval := conf.GPSInterval
+	if interval <= 0 {
+		interval = defaultGPSInterval
+	}
+	intervalNanos := int64(interval * float64(time.Second))
+	windowStart := trackpointPrepper.WindowStart
+	windowEnd := trackpointPrepper.WindowEnd
+	inWindow := func(t time.Time) bool {
+		return !t.Before(windowStart) && t.Before(windowEnd)
+	}
+
+	// A taxi may have several routes in a window, which must be replayed in order because of reservations.
+	routes := make([]*preparedRoute, len(trackpointPrepper.Routes))
+	copy(routes, trackpointPrepper.Routes)
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].PuTime.Before(routes[j].PuTime) })
+
+	updates := make([]*messages.Envelope, 0)
+	for _, r := range routes {
+		if inWindow(r.PuTime) {
+			updates = append(updates, routeStartUpdates(r, r.PuTime)...)
+		}
+
+		// The taxis do not all report at the same time, but each at its own phase within the interval.
+		phase := int64(math.Mod(float64(r.TaxiId)*0.618034, 1) * float64(intervalNanos))
+		first := windowStart.UnixNano() - phase
+		first = first - first%intervalNanos + phase
+		if first < windowStart.UnixNano() {
+			first += intervalNanos
+		}
+		for t := time.Unix(0, first).UTC(); t.Before(windowEnd); t = t.Add(time.Duration(intervalNanos)) {
+			if !t.After(r.PuTime) || !t.Before(r.DoTime) {
+				continue
+			}
+			// As in the padded mode, about one taxi every 10 seconds gets a reservation.
+			if r.PassengerCount == 0 && rand.Float64() < interval/(10.0*float64(len(routes))) {
+				updates = append(updates, reserve(trackpointPrepper, r, t))
+			}
+			updates = append(updates, locationUpdate(trackpointPrepper, r, t))
+		}
 
-		trackpointPrepper.WindowStart = trackpointPrepper.WindowStart.Add(time.Second * time.Duration(windowSize*timeWarp))
-		trackpointPrepper.WindowEnd = trackpointPrepper.WindowEnd.Add(time.Second * time.Duration(windowSize*timeWarp))
-	} else {
-		trackpointPrepper.WindowStart = time.Date(2016, time.January, 1, 0, 29, 20, 0, time.UTC)
-		trackpointPrepper.WindowEnd = time.Date(2016, time.January, 1, 0, 29, int(20+windowSize*conf.TimeWarp), 0, time.UTC)
+		if inWindow(r.DoTime) {
+			updates = append(updates, routeEndUpdates(r, r.DoTime)...)
+			delete(trackpointPrepper.ReservedTaxis, r.TaxiId)
+		}
+	}
+	sort.SliceStable(updates, func(i, j int) bool { return updates[i].Ts.EventTime < updates[j].Ts.EventTime })
+	return updates
+}
+
+// The messages at the start of a route. While the taxi stands still for passengers to alight, there is nothing new.
+func routeStartUpdates(r *preparedRoute, t time.Time) []*messages.Envelope {
+	switch r.TripType {
+	case base.TripTypeBoarding:
+		return []*messages.Envelope{messages.NewEnvelope(&messages.PickupStartedUpdate{TaxiId: r.TaxiId,
+			Lon: r.StartLon, Lat: r.StartLat, PassengerCount: r.PassengerCount,
+			DwellTime: r.DoTime.Sub(r.PuTime).Seconds()}, t)}
+	case base.TripTypeAlighting:
+		return nil
+	default:
+		return pickupUpdates(r, t)
 	}
 }
 
+// The messages at the end of a route. Boarding ends when the route with the passengers starts.
+func routeEndUpdates(r *preparedRoute, t time.Time) []*messages.Envelope {
+	switch r.TripType {
+	case base.TripTypeBoarding:
+		return nil
+	case base.TripTypeAlighting:
+		return []*messages.Envelope{messages.NewEnvelope(&messages.DropoffCompletedUpdate{TaxiId: r.TaxiId,
+			Lon: r.EndLon, Lat: r.EndLat, PassengerCount: r.PassengerCount,
+			DwellTime: r.DoTime.Sub(r.PuTime).Seconds()}, t)}
+	default:
+		return []*messages.Envelope{routeCompletedUpdate(r, t)}
+	}
+}
+
+// The occupancy and destination messages at the start of a route.
+// Since we include all messages in both streams, here we kinda redundantly send both messages.
+func pickupUpdates(r *preparedRoute, t time.Time) []*messages.Envelope {
+	return []*messages.Envelope{
+		messages.NewEnvelope(&messages.TaxiOccupancyUpdate{TaxiId: r.TaxiId,
+			NumOccupants: r.PassengerCount, DestLon: r.EndLon, DestLat: r.EndLat}, t),
+		messages.NewEnvelope(&messages.TaxiDestinationUpdate{TaxiId: r.TaxiId,
+			NumOccupants: r.PassengerCount, DestLon: r.EndLon, DestLat: r.EndLat}, t)}
+}
+
+// The journey (esp. price) information at the end of a route.
+func routeCompletedUpdate(r *preparedRoute, t time.Time) *messages.Envelope {
+	return messages.NewEnvelope(&messages.TaxiRouteCompletedUpdate{TaxiId: r.TaxiId,
+		PassengerCount: r.PassengerCount, Distance: r.Distance, Duration: r.Duration,
+		FareAmount: r.FareAmount, Extra: r.Extra, MTATax: r.MTATax, TipAmount: r.TipAmount,
+		TollsAmount: r.TollsAmount, EHailFee: r.EHailFee, ImprovementSurcharge: r.ImprovementSurcharge,
+		TotalAmount: r.TotalAmount, PaymentType: r.PaymentType, TripType: r.TripType}, t)
+}
+
+// Orders the taxi of a route to the end of the route until the route is completed.
+func reserve(trackpointPrepper *TrackpointPrepper, r *preparedRoute, t time.Time) *messages.Envelope {
+	trackpointPrepper.ReservedTaxis[r.TaxiId] = true
+	return messages.NewEnvelope(&messages.TaxiReservationUpdate{TaxiId: r.TaxiId,
+		ReservationLon: r.EndLon, ReservationLat: r.EndLat}, t)
+}
+
+// The location of the taxi of a route at the given time. With GPS noise, the time is not exactly the given one.
+func locationUpdate(trackpointPrepper *TrackpointPrepper, r *preparedRoute, t time.Time) *messages.Envelope {
+	if trackpointPrepper.Noise != nil {
+		t = trackpointPrepper.Noise.Jitter(t)
+	}
+	perc := math.Max(0, math.Min(trackpointPrepper.Speeds.Progress(r.PuTime, r.DoTime, t), 1))
+	lon, lat := r.Along(perc)
+	heading, travelled := r.Movement(perc)
+	speed := trackpointPrepper.Speeds.SpeedAt(r.PuTime, r.DoTime, r.Length(), t)
+	u := &messages.TaxiUpdate{TaxiId: r.TaxiId, Lon: lon, Lat: lat, NumOccupants: r.PassengerCount,
+		Heading: heading, Speed: speed, DistanceTravelled: travelled, DistanceRemaining: r.Length() - travelled}
+	if r.PassengerCount > 0 {
+		u.DestLon = &r.EndLon
+		u.DestLat = &r.EndLat
+	}
+	if trackpointPrepper.ReservedTaxis[r.TaxiId] {
+		u.ReservationLon = &r.EndLon
+		u.ReservationLat = &r.EndLat
+	}
+	return messages.NewEnvelope(u, t)
+}
+
+// Determines the range of simulated time to replay. Unless configured, this is the whole dataset.
+func replayRange(conf base.Configuration, store storage.MovementStore) (time.Time, time.Time) {
+	start, end, err := store.TimeRange()
+	if err != nil {
+		panic(err)
+	}
+	if conf.ReplayStart != "" {
+		start, err = time.Parse(replayTimeFormat, conf.ReplayStart)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if conf.ReplayEnd != "" {
+		end, err = time.Parse(replayTimeFormat, conf.ReplayEnd)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return start, end
+}
+
 // Sets up the trackpoint preparation component.
-func setUpTrackpointPrep(conf base.Configuration, streamer Streamer) {
-	db := connectToDatabase(conf)
+func setUpTrackpointPrep(conf base.Configuration, streamer *Streamer) *TrackpointPrepper {
+	store, err := storage.Open(conf)
+	if err != nil {
+		panic(err)
+	}
+	switch conf.ReplayEndBehaviour {
+	case "", "loop", "stop", "idle":
+	default:
+		panic("unknown replayEndBehaviour '" + conf.ReplayEndBehaviour + "', use one of {'loop', 'stop', 'idle'}")
+	}
+	switch conf.ReplayMode {
+	case "", replayPadded, replayEventTime:
+	default:
+		panic("unknown replayMode '" + conf.ReplayMode + "', use one of {'padded', 'event-time'}")
+	}
+	switch conf.BackpressurePolicy {
+	case "", backpressureBlock, backpressureAdapt, backpressureShed:
+	default:
+		panic("unknown backpressurePolicy '" + conf.BackpressurePolicy + "', use one of {'block', 'adapt', 'shed'}")
+	}
+
 	windowSize := conf.TrackpointPrepWindowSize
-	trackpointPrepper := TrackpointPrepper{
-		time.Date(2016, time.January, 1, 0, 29, 20, 0, time.UTC),
-		time.Date(2016, time.January, 1, 0, 29, int(20+windowSize*conf.TimeWarp), 0, time.UTC),
-		make([]Route, 0), make(map[int32]bool)}
+	trackpointPrepper := &TrackpointPrepper{TimeWarp: conf.TimeWarp, TargetSpeed: conf.TargetSpeedPerSecond,
+		WindowSize: windowSize, seeked: make(chan struct{}), quit: make(chan struct{}), stopped: make(chan struct{})}
+	trackpointPrepper.ReplayStart, trackpointPrepper.ReplayEnd = replayRange(conf, store)
+	fmt.Println("Replaying", trackpointPrepper.ReplayStart, "-", trackpointPrepper.ReplayEnd)
+	resetWindow(trackpointPrepper, trackpointPrepper.ReplayStart)
+	trackpointPrepper.Noise, err = newGPSNoise(conf.GPSNoise)
+	if err != nil {
+		panic(err)
+	}
+	trackpointPrepper.Speeds, err = taxisim.NewSpeedModel(conf)
+	if err != nil {
+		panic(err)
+	}
+	if conf.PreloadRoutes {
+		fmt.Println("Preloading routes into memory.")
+		trackpointPrepper.RouteIndex, err = loadRouteIndex(store)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Preloaded routes:", len(trackpointPrepper.RouteIndex.routes))
+	}
 
 	ticker := time.NewTicker(time.Duration(windowSize) * time.Second)
-	quit := make(chan struct{})
-	prepTrackpoints(&trackpointPrepper, &streamer, db, conf)
 
 	go func() {
-		for {
+		defer close(trackpointPrepper.stopped)
+		stop := prepTrackpoints(trackpointPrepper, streamer, store, conf)
+		for !stop {
 			select {
 			case <-ticker.C:
-				prepTrackpoints(&trackpointPrepper, &streamer, db, conf)
-			case <-quit:
-				ticker.Stop()
-				db.Close()
-				return
+				// While the stream is paused, the replay does not advance (and nothing is sent).
+				if !streamer.IsPaused() {
+					stop = prepTrackpoints(trackpointPrepper, streamer, store, conf)
+				} else {
+					trackpointPrepper.mutex.Lock()
+					trackpointPrepper.lastSeqTime = time.Time{}
+					trackpointPrepper.mutex.Unlock()
+				}
+			case <-trackpointPrepper.quit:
+				stop = true
 			}
 		}
+		ticker.Stop()
+		store.Close()
+		if trackpointPrepper.Noise != nil {
+			trackpointPrepper.Noise.Close()
+		}
 	}()
+	return trackpointPrepper
 }